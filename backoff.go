@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff is an exponential retry policy shared by the monitors
+type Backoff struct {
+	// Min is the delay before the first retry. It doubles on each subsequent one up to Max
+	Min time.Duration
+	Max time.Duration
+	// Jitter is the fraction of the delay to be randomized, between 0 and 1
+	Jitter float64
+}
+
+// Delay returns the delay before the retry number attempt starting from 0
+func (b *Backoff) Delay(attempt int) time.Duration {
+	d := float64(b.Min) * math.Pow(2, float64(attempt))
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// Wait sleeps before the retry number attempt. It returns false if the context is cancelled
+func (b *Backoff) Wait(ctx context.Context, attempt int) bool {
+	t := time.NewTimer(b.Delay(attempt))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
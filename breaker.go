@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrCircuitOpen is returned by the circuit breaker instead of sending the request to a failing node
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half_open"
+	case BreakerOpen:
+		return "open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int(s))
+	}
+}
+
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+type CircuitBreakerConfig struct {
+	// Threshold is the number of consecutive failures opening the circuit. 0 disables the breaker
+	Threshold int
+	// Cooldown is the policy of the open state duration. It grows with each failed probe
+	Cooldown  Backoff
+	Transport http.RoundTripper
+	Reg       prometheus.Registerer
+	Logger    log.FieldLogger
+}
+
+// CircuitBreaker is a RoundTripper which stops sending requests to the node after a number of consecutive failures.
+// Once the cooldown period is over a single probe request is let through to check if the node is back
+type CircuitBreaker struct {
+	cfg CircuitBreakerConfig
+
+	mtx      sync.Mutex
+	state    BreakerState
+	failures int
+	// opened is the number of consecutive openings used to grow the cooldown
+	opened  int
+	until   time.Time
+	probing bool
+	since   time.Time
+	err     error
+
+	stateGauge prometheus.Gauge
+}
+
+func (c *CircuitBreakerConfig) New() *CircuitBreaker {
+	b := &CircuitBreaker{
+		cfg:   *c,
+		since: time.Now(),
+		stateGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "circuit_breaker_state",
+			Help:      "RPC circuit breaker state: 0 closed, 1 half open, 2 open.",
+		}),
+	}
+	if b.cfg.Transport == nil {
+		b.cfg.Transport = http.DefaultTransport
+	}
+	if c.Reg != nil {
+		c.Reg.MustRegister(b.stateGauge)
+	}
+	return b
+}
+
+// State returns the current state and the last failure
+func (b *CircuitBreaker) State() (BreakerState, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.state, b.err
+}
+
+// setState must be called with the lock held
+func (b *CircuitBreaker) setState(s BreakerState) {
+	if s == b.state {
+		return
+	}
+	b.cfg.Logger.WithFields(log.Fields{"from": b.state, "to": s}).Info("circuit breaker state changed")
+	b.state = s
+	b.since = time.Now()
+	b.stateGauge.Set(float64(s))
+}
+
+func (b *CircuitBreaker) allow() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if wait := time.Until(b.until); wait > 0 {
+			return fmt.Errorf("%w, retrying in %v", ErrCircuitOpen, wait.Round(time.Millisecond))
+		}
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+	case BreakerHalfOpen:
+		if b.probing {
+			return fmt.Errorf("%w, probing", ErrCircuitOpen)
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// failed reports if the response indicates the node or the path to it is down
+func failed(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (b *CircuitBreaker) report(req *http.Request, res *http.Response, err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.probing = false
+	if errors.Is(req.Context().Err(), context.Canceled) {
+		// the result says nothing about the node
+		return
+	}
+	if !failed(res, err) {
+		b.failures, b.opened, b.err = 0, 0, nil
+		b.setState(BreakerClosed)
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("http status %d", res.StatusCode)
+	}
+	b.err = err
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.cfg.Threshold {
+		b.until = time.Now().Add(b.cfg.Cooldown.Delay(b.opened))
+		b.opened++
+		b.setState(BreakerOpen)
+	}
+}
+
+func (b *CircuitBreaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	if b.cfg.Threshold <= 0 {
+		return b.cfg.Transport.RoundTrip(req)
+	}
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	res, err := b.cfg.Transport.RoundTrip(req)
+	b.report(req, res, err)
+	return res, err
+}
+
+func (b *CircuitBreaker) Name() string {
+	return "circuit_breaker"
+}
+
+func (b *CircuitBreaker) Metadata() *CheckMetadata {
+	return &CheckMetadata{
+		Description: "The RPC circuit breaker is closed",
+	}
+}
+
+func (b *CircuitBreaker) Evaluate() *CheckResult {
+	b.mtx.Lock()
+	state, since, err := b.state, b.since, b.err
+	b.mtx.Unlock()
+	res := CheckResult{
+		Status:  CheckPass,
+		Value:   state,
+		Updated: since,
+	}
+	switch state {
+	case BreakerOpen:
+		res.Status = CheckFail
+	case BreakerHalfOpen:
+		res.Status = CheckWarn
+	}
+	if state != BreakerClosed && err != nil {
+		res.Reason = fmt.Sprintf("the circuit is %v after %v", state, err)
+	}
+	return &res
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	tz "github.com/ecadlabs/gotez/v2"
+	client "github.com/ecadlabs/gotez/v2/clientv2"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+type ChainMonitorConfig struct {
+	Client *client.Client
+	// ChainID is the expected chain ID. If nil then the one reported by the node on startup is expected
+	ChainID  *tz.ChainID
+	Timeout  time.Duration
+	Interval time.Duration
+	Reg      prometheus.Registerer
+	Logger   log.FieldLogger
+	Events   EventSink
+}
+
+// ChainMonitor detects the node's chain ID and periodically makes sure it didn't change
+type ChainMonitor struct {
+	cfg ChainMonitorConfig
+
+	mtx      sync.RWMutex
+	expected *tz.ChainID
+	current  *tz.ChainID
+	updated  time.Time
+	err      error
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	infoGauge *prometheus.GaugeVec
+}
+
+// New returns a chain monitor. If the chain ID is not configured it's detected on the first poll,
+// "main" is used until then
+func (c *ChainMonitorConfig) New() *ChainMonitor {
+	m := &ChainMonitor{
+		cfg:      *c,
+		expected: c.ChainID,
+		infoGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "info",
+			Help:      "Node information. The value is always 1.",
+		}, []string{"chain_id"}),
+	}
+	if c.Reg != nil {
+		c.Reg.MustRegister(m.infoGauge)
+	}
+	return m
+}
+
+// inherit carries over the chain ID detected by the replaced monitor, so that a node re-pointed to another chain
+// isn't accepted as is after a reload. Must be called before Start
+func (m *ChainMonitor) inherit(old *ChainMonitor) {
+	old.mtx.RLock()
+	expected, current, updated, err := old.expected, old.current, old.updated, old.err
+	old.mtx.RUnlock()
+	if m.cfg.ChainID != nil || expected == nil {
+		return
+	}
+	m.mtx.Lock()
+	m.expected = expected
+	// the mismatch is reported on the next poll
+	m.current, m.updated, m.err = current, updated, err
+	m.mtx.Unlock()
+}
+
+// ID returns the expected chain ID or nil if it's not known yet
+func (m *ChainMonitor) ID() *tz.ChainID {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.expected
+}
+
+// String returns the chain ID to be used in RPC paths, "main" if it's not known yet
+func (m *ChainMonitor) String() string {
+	if id := m.ID(); id != nil {
+		return id.String()
+	}
+	return "main"
+}
+
+// Resolve returns the expected chain ID detecting it if necessary
+func (m *ChainMonitor) Resolve(ctx context.Context) (*tz.ChainID, error) {
+	if id := m.ID(); id != nil {
+		return id, nil
+	}
+	return m.poll(ctx)
+}
+
+func (m *ChainMonitor) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.done = make(chan struct{})
+	go m.loop(ctx)
+}
+
+func (m *ChainMonitor) Stop(ctx context.Context) error {
+	m.cancel()
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *ChainMonitor) loop(ctx context.Context) {
+	t := time.NewTicker(m.cfg.Interval)
+	defer func() {
+		t.Stop()
+		close(m.done)
+	}()
+
+	for {
+		if _, err := m.poll(ctx); err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			if m.ID() == nil {
+				m.cfg.Logger.Warnf("chain ID detection failed, using \"main\": %v", err)
+			} else {
+				m.cfg.Logger.Warn(err)
+			}
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// poll fetches the node's chain ID. The first detected ID becomes the expected one if it's not configured
+func (m *ChainMonitor) poll(ctx context.Context) (*tz.ChainID, error) {
+	c, cancel := context.WithTimeout(ctx, m.cfg.Timeout)
+	defer cancel()
+	id, err := getChainID(c, m.cfg.Client)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			m.mtx.Lock()
+			m.err = err
+			m.mtx.Unlock()
+		}
+		return nil, err
+	}
+
+	m.mtx.Lock()
+	detected := m.expected == nil
+	if detected {
+		m.expected = id
+	}
+	prev, expected := m.current, m.expected
+	m.current = id
+	m.updated = time.Now()
+	m.err = nil
+	m.mtx.Unlock()
+
+	if detected {
+		m.cfg.Logger.WithField("chain_id", id).Info("chain ID detected")
+	}
+	if prev == nil || *prev != *id {
+		m.infoGauge.Reset()
+		m.infoGauge.With(prometheus.Labels{"chain_id": id.String()}).Set(1)
+	}
+	wasMatching := prev == nil || *prev == *expected
+	matching := *id == *expected
+	if wasMatching != matching {
+		if matching {
+			m.cfg.Logger.WithField("chain_id", id).Info("chain ID matches the expected one again")
+		} else {
+			m.cfg.Logger.WithFields(log.Fields{"expected": expected, "chain_id": id}).Error("chain ID mismatch")
+		}
+		if m.cfg.Events != nil {
+			m.cfg.Events.Publish(EventChainID, &ChainIDEvent{
+				Expected: expected,
+				ChainID:  id,
+				Mismatch: !matching,
+			})
+		}
+	}
+	return id, nil
+}
+
+func (m *ChainMonitor) Name() string {
+	return "chain_id"
+}
+
+func (m *ChainMonitor) Metadata() *CheckMetadata {
+	return &CheckMetadata{
+		Description: "The node's chain ID matches the configured or initially detected one",
+	}
+}
+
+func (m *ChainMonitor) Evaluate() *CheckResult {
+	m.mtx.RLock()
+	expected, current, updated, err := m.expected, m.current, m.updated, m.err
+	m.mtx.RUnlock()
+	res := CheckResult{
+		Status:    checkStatus(current != nil && *current == *expected),
+		Value:     current,
+		Threshold: expected,
+		Updated:   updated,
+	}
+	switch {
+	case current == nil && err != nil:
+		res.Reason = err.Error()
+	case current == nil:
+		res.Reason = "chain ID is not known yet"
+	case *current != *expected:
+		res.Reason = fmt.Sprintf("the node is on chain %v, expected %v", current, expected)
+	}
+	return &res
+}
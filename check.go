@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// checkNodes connects to the nodes and the reference nodes and makes sure they're on the configured chain
+func (c *Config) checkNodes(ctx context.Context) error {
+	var errs []error
+	for _, nc := range c.NodeList() {
+		cctx, cancel := context.WithTimeout(ctx, c.Timeout)
+		id, err := getChainID(cctx, newClient(nc.URL))
+		cancel()
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s: %w", nc.Name, err))
+		case nc.ChainID != nil && *nc.ChainID != *id:
+			errs = append(errs, fmt.Errorf("%s: chain ID mismatch: configured %v, node reports %v", nc.Name, nc.ChainID, id))
+		}
+	}
+	for _, u := range c.References {
+		cctx, cancel := context.WithTimeout(ctx, c.Timeout)
+		_, err := getChainID(cctx, newClient(u))
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("reference %s: %w", u, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkConfig implements `check-config` (alias `validate`) subcommand. It returns the process exit code
+func checkConfig(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	src := ConfigSource{Strict: true}
+	fs.StringVar(&src.Path, "c", "", "Config file path")
+	connect := fs.Bool("connect", false, "Connect to the nodes to verify that they are reachable and the chain IDs match")
+	quiet := fs.Bool("q", false, "Don't print the effective config")
+	src.RegisterFlags(fs)
+	fs.Parse(args)
+
+	conf, err := src.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	problems := []error{conf.Validate()}
+	if *connect {
+		problems = append(problems, conf.checkNodes(context.Background()))
+	}
+	if err := errors.Join(problems...); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if !*quiet {
+		buf, err := yaml.Marshal(conf)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		os.Stdout.Write(buf)
+	}
+	fmt.Fprintln(os.Stderr, "configuration is valid")
+	return 0
+}
@@ -1,20 +1,531 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	tz "github.com/ecadlabs/gotez/v2"
+	"gopkg.in/yaml.v3"
 )
 
+const defaultNodeName = "default"
+
+const (
+	defaultListen            = ":8080"
+	defaultTimeout           = 30 * time.Second
+	defaultTolerance         = 1 * time.Second
+	defaultReconnectDelay    = 10 * time.Second
+	defaultReconnectMaxDelay = 5 * time.Minute
+	defaultReconnectJitter   = 0.2
+	defaultBreakerThreshold  = 5
+	defaultBreakerCooldown   = 10 * time.Second
+	defaultPollInterval      = 15 * time.Second
+	defaultMaxLevelLag       = 2
+	defaultDegradedCode      = http.StatusMultiStatus
+	defaultHealthInterval    = 1 * time.Second
+	defaultEventBuffer       = 1000
+	defaultReorgWindow       = 64
+	defaultReorgHold         = 10 * time.Minute
+	defaultStallFactor       = 5
+)
+
+type NodeConfig struct {
+	Name        string        `yaml:"name"`
+	URL         string        `yaml:"url"`
+	ChainID     *tz.ChainID   `yaml:"chain_id"`
+	ProxyListen string        `yaml:"proxy_listen"`
+	ProxyFilter *FilterConfig `yaml:"proxy_filter"`
+}
+
+// MarshalJSON redacts the credentials in the URL, the JSON form is used for logging only
+func (c NodeConfig) MarshalJSON() ([]byte, error) {
+	type nodeConfig NodeConfig
+	out := nodeConfig(c)
+	out.URL = redactURL(c.URL)
+	return json.Marshal(&out)
+}
+
+// HealthConfig lists the names of health checks by the way they affect the `/health` output
+type HealthConfig struct {
+	Required      []string `yaml:"required"`
+	Degraded      []string `yaml:"degraded"`
+	Informational []string `yaml:"informational"`
+}
+
+// ProbesConfig lists the names of health checks used by each of the Kubernetes style probes
+type ProbesConfig struct {
+	Livez    []string `yaml:"livez"`
+	Readyz   []string `yaml:"readyz"`
+	Startupz []string `yaml:"startupz"`
+}
+
 type Config struct {
-	Listen                string        `yaml:"listen"`
-	URL                   string        `yaml:"url"`
-	ChainID               *tz.ChainID   `yaml:"chain_id"`
-	Timeout               time.Duration `yaml:"timeout"`
-	Tolerance             time.Duration `yaml:"tolerance"`
-	ReconnectDelay        time.Duration `yaml:"reconnect_delay"`
-	UseTimestamps         bool          `yaml:"use_timestamps"`
-	PollInterval          time.Duration `yaml:"poll_interval"`
-	HealthUseBootstrapped bool          `yaml:"health_use_bootstrapped"`
-	HealthUseBlockDelay   bool          `yaml:"health_use_block_delay"`
+	Listen                string           `yaml:"listen"`
+	AdminListen           string           `yaml:"admin_listen"`
+	URL                   string           `yaml:"url"`
+	ChainID               *tz.ChainID      `yaml:"chain_id"`
+	ProxyListen           string           `yaml:"proxy_listen"`
+	ProxyFilter           *FilterConfig    `yaml:"proxy_filter"`
+	Filter                *FilterConfig    `yaml:"filter"`
+	Nodes                 []*NodeConfig    `yaml:"nodes"`
+	Timeout               time.Duration    `yaml:"timeout"`
+	Tolerance             time.Duration    `yaml:"tolerance"`
+	DegradedTolerance     time.Duration    `yaml:"degraded_tolerance"`
+	ReconnectDelay        time.Duration    `yaml:"reconnect_delay"`
+	ReconnectMaxDelay     time.Duration    `yaml:"reconnect_max_delay"`
+	ReconnectJitter       float64          `yaml:"reconnect_jitter"`
+	BreakerThreshold      int              `yaml:"circuit_breaker_threshold"`
+	BreakerCooldown       time.Duration    `yaml:"circuit_breaker_cooldown"`
+	UseTimestamps         bool             `yaml:"use_timestamps"`
+	ReorgWindow           int              `yaml:"reorg_window"`
+	MaxReorgDepth         int32            `yaml:"max_reorg_depth"`
+	ReorgHold             time.Duration    `yaml:"reorg_hold"`
+	StallFactor           float64          `yaml:"stall_factor"`
+	PollInterval          time.Duration    `yaml:"poll_interval"`
+	HealthUseBootstrapped bool             `yaml:"health_use_bootstrapped"`
+	HealthUseBlockDelay   bool             `yaml:"health_use_block_delay"`
+	References            []string         `yaml:"references"`
+	MaxLevelLag           int32            `yaml:"max_level_lag"`
+	HealthUseHeadLag      bool             `yaml:"health_use_head_lag"`
+	MinConnections        int              `yaml:"min_connections"`
+	MaxBranchDelayed      int              `yaml:"max_branch_delayed"`
+	MempoolRejections     int              `yaml:"mempool_rejections"`
+	Health                *HealthConfig    `yaml:"health"`
+	Probes                *ProbesConfig    `yaml:"probes"`
+	HealthDegradedCode    int              `yaml:"health_degraded_code"`
+	HealthDegradedBody    string           `yaml:"health_degraded_body"`
+	HealthInterval        time.Duration    `yaml:"health_interval"`
+	HealthRise            int              `yaml:"health_rise"`
+	HealthFall            int              `yaml:"health_fall"`
+	HealthMinHold         time.Duration    `yaml:"health_min_hold"`
+	EventBuffer           int              `yaml:"event_buffer"`
+	Webhooks              []*WebhookConfig `yaml:"webhooks"`
+	History               *HistoryConfig   `yaml:"history"`
+	SLO                   *SLOConfig       `yaml:"slo"`
+}
+
+// MarshalJSON redacts the credentials in the node and reference URLs, the JSON form is used for logging only
+func (c Config) MarshalJSON() ([]byte, error) {
+	type config Config
+	out := config(c)
+	out.URL = redactURL(c.URL)
+	if c.References != nil {
+		out.References = make([]string, len(c.References))
+		for i, u := range c.References {
+			out.References[i] = redactURL(u)
+		}
+	}
+	return json.Marshal(&out)
+}
+
+// NodeList returns the list of monitored nodes. The top level `url` and `chain_id` pair,
+// if present, is treated as a node named "default"
+func (c *Config) NodeList() []*NodeConfig {
+	if c.URL == "" {
+		return c.Nodes
+	}
+	nodes := make([]*NodeConfig, 0, len(c.Nodes)+1)
+	nodes = append(nodes, &NodeConfig{
+		Name:        defaultNodeName,
+		URL:         c.URL,
+		ChainID:     c.ChainID,
+		ProxyListen: c.ProxyListen,
+		ProxyFilter: c.ProxyFilter,
+	})
+	return append(nodes, c.Nodes...)
+}
+
+// HealthChecks returns the health check modes. If the `health` section is absent
+// the list of required checks is derived from `health_use_*` flags
+func (c *Config) HealthChecks() *HealthConfig {
+	if c.Health != nil {
+		return c.Health
+	}
+	conf := HealthConfig{
+		Required: []string{"chain_id"},
+		Degraded: []string{"connections", "branch_delayed", "reorg"},
+	}
+	if c.HealthUseBootstrapped {
+		conf.Required = append(conf.Required, "bootstrapped")
+	}
+	if c.HealthUseBlockDelay {
+		conf.Required = append(conf.Required, "block_delay")
+	}
+	if c.HealthUseHeadLag && len(c.References) != 0 {
+		conf.Required = append(conf.Required, "head_lag")
+	}
+	return &conf
+}
+
+// ReconnectBackoff returns the retry policy of the monitors
+func (c *Config) ReconnectBackoff() Backoff {
+	return Backoff{
+		Min:    c.ReconnectDelay,
+		Max:    c.ReconnectMaxDelay,
+		Jitter: c.ReconnectJitter,
+	}
+}
+
+// AvailableChecks returns the names of the health checks provided by the node's monitors
+func (c *Config) AvailableChecks() []string {
+	names := []string{"rpc", "bootstrapped", "block_delay", "connections", "branch_delayed", "chain_id", "reorg", "circuit_breaker"}
+	if len(c.References) != 0 {
+		names = append(names, "head_lag")
+	}
+	return names
+}
+
+// ProbeChecks returns the probes' check lists. By default `/livez` uses the `rpc` check,
+// `/readyz` uses the required health checks and `/startupz` uses the `bootstrapped` check
+func (c *Config) ProbeChecks() *ProbesConfig {
+	conf := ProbesConfig{
+		Livez:    []string{"rpc"},
+		Readyz:   c.HealthChecks().Required,
+		Startupz: []string{"bootstrapped"},
+	}
+	if c.Probes != nil {
+		if c.Probes.Livez != nil {
+			conf.Livez = c.Probes.Livez
+		}
+		if c.Probes.Readyz != nil {
+			conf.Readyz = c.Probes.Readyz
+		}
+		if c.Probes.Startupz != nil {
+			conf.Startupz = c.Probes.Startupz
+		}
+	}
+	return &conf
+}
+
+// DefaultConfig returns the configuration used for the fields absent in the config file
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:                defaultListen,
+		Timeout:               defaultTimeout,
+		Tolerance:             defaultTolerance,
+		ReconnectDelay:        defaultReconnectDelay,
+		ReconnectMaxDelay:     defaultReconnectMaxDelay,
+		ReconnectJitter:       defaultReconnectJitter,
+		BreakerThreshold:      defaultBreakerThreshold,
+		BreakerCooldown:       defaultBreakerCooldown,
+		HealthUseBlockDelay:   true,
+		HealthUseBootstrapped: true,
+		PollInterval:          defaultPollInterval,
+		MaxLevelLag:           defaultMaxLevelLag,
+		HealthUseHeadLag:      true,
+		HealthDegradedCode:    defaultDegradedCode,
+		HealthInterval:        defaultHealthInterval,
+		HealthRise:            1,
+		HealthFall:            1,
+		EventBuffer:           defaultEventBuffer,
+		ReorgWindow:           defaultReorgWindow,
+		ReorgHold:             defaultReorgHold,
+		StallFactor:           defaultStallFactor,
+	}
+}
+
+func decodeYAML(buf []byte, v any, strict bool) error {
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(strict)
+	if err := dec.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// LoadConfig reads the config file on top of the defaults. Unknown fields are errors in strict mode
+func LoadConfig(path string, strict bool) (*Config, error) {
+	conf := DefaultConfig()
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := decodeYAML(buf, conf, strict); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return conf, nil
+}
+
+func validateURL(u string) error {
+	v, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if v.Scheme != "http" && v.Scheme != "https" || v.Host == "" {
+		return fmt.Errorf("invalid URL: %s", u)
+	}
+	return nil
+}
+
+// Validate checks the configuration for errors which can be detected without contacting the nodes
+func (c *Config) Validate() error {
+	var errs []error
+	nodes := c.NodeList()
+	if len(nodes) == 0 {
+		errs = append(errs, errors.New("no nodes configured"))
+	}
+	names := make(map[string]struct{}, len(nodes))
+	for _, nc := range nodes {
+		if nc.Name == "" {
+			errs = append(errs, errors.New("node name is missing"))
+			continue
+		}
+		if _, ok := names[nc.Name]; ok {
+			errs = append(errs, fmt.Errorf("duplicate node name: %s", nc.Name))
+		}
+		names[nc.Name] = struct{}{}
+		if err := validateURL(nc.URL); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", nc.Name, err))
+		}
+	}
+	for _, u := range c.References {
+		if err := validateURL(u); err != nil {
+			errs = append(errs, fmt.Errorf("references: %w", err))
+		}
+	}
+	durations := []struct {
+		name     string
+		v        time.Duration
+		positive bool
+	}{
+		{"timeout", c.Timeout, true},
+		{"poll_interval", c.PollInterval, true},
+		{"health_interval", c.HealthInterval, true},
+		{"tolerance", c.Tolerance, false},
+		{"degraded_tolerance", c.DegradedTolerance, false},
+		{"reconnect_delay", c.ReconnectDelay, false},
+		{"reconnect_max_delay", c.ReconnectMaxDelay, false},
+		{"circuit_breaker_cooldown", c.BreakerCooldown, false},
+		{"health_min_hold", c.HealthMinHold, false},
+		{"reorg_hold", c.ReorgHold, false},
+	}
+	for _, d := range durations {
+		switch {
+		case d.positive && d.v <= 0:
+			errs = append(errs, fmt.Errorf("%s must be positive", d.name))
+		case d.v < 0:
+			errs = append(errs, fmt.Errorf("%s must not be negative", d.name))
+		}
+	}
+	if c.ReorgWindow < 1 {
+		errs = append(errs, errors.New("reorg_window must be at least 1"))
+	}
+	if c.ReconnectJitter < 0 || c.ReconnectJitter > 1 {
+		errs = append(errs, errors.New("reconnect_jitter must be between 0 and 1"))
+	}
+	if c.BreakerThreshold < 0 {
+		errs = append(errs, errors.New("circuit_breaker_threshold must not be negative"))
+	}
+	if c.AdminListen != "" && c.AdminListen == c.Listen {
+		errs = append(errs, errors.New("admin_listen must differ from listen"))
+	}
+	if c.MempoolRejections < 0 {
+		errs = append(errs, errors.New("mempool_rejections must not be negative"))
+	}
+	if c.StallFactor < 0 {
+		errs = append(errs, errors.New("stall_factor must not be negative"))
+	}
+	if c.MaxReorgDepth < 0 {
+		errs = append(errs, errors.New("max_reorg_depth must not be negative"))
+	}
+	if c.HealthRise < 1 || c.HealthFall < 1 {
+		errs = append(errs, errors.New("health_rise and health_fall must be at least 1"))
+	}
+	if c.HealthDegradedCode < 100 || c.HealthDegradedCode > 599 {
+		errs = append(errs, fmt.Errorf("invalid health_degraded_code: %d", c.HealthDegradedCode))
+	}
+
+	// the listeners' filters
+	if c.Filter != nil {
+		if _, err := c.Filter.New(c.Listen, nil); err != nil {
+			errs = append(errs, fmt.Errorf("filter: %w", err))
+		}
+	}
+	for _, nc := range nodes {
+		if nc.ProxyFilter != nil {
+			if _, err := nc.ProxyFilter.New(nc.ProxyListen, nil); err != nil {
+				errs = append(errs, fmt.Errorf("%s: proxy_filter: %w", nc.Name, err))
+			}
+		}
+	}
+
+	for i, wc := range c.Webhooks {
+		name := wc.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		if err := validateURL(wc.URL); err != nil {
+			errs = append(errs, fmt.Errorf("webhook %s: %w", name, err))
+		}
+		if _, err := wc.New(nil, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.History != nil {
+		if c.History.Path == "" {
+			errs = append(errs, errors.New("history: path is missing"))
+		}
+		if c.History.Retention < 0 {
+			errs = append(errs, errors.New("history: retention must not be negative"))
+		}
+	}
+
+	if c.SLO != nil {
+		if c.SLO.Target != 0 && (c.SLO.Target <= 0 || c.SLO.Target >= 1) {
+			errs = append(errs, errors.New("slo: target must be between 0 and 1"))
+		}
+		if c.SLO.Interval < 0 {
+			errs = append(errs, errors.New("slo: interval must not be negative"))
+		}
+		for _, w := range c.SLO.Windows {
+			if w <= 0 {
+				errs = append(errs, fmt.Errorf("slo: invalid window: %v", w))
+			}
+		}
+	}
+
+	// the checks' names
+	available := c.AvailableChecks()
+	health := c.HealthChecks()
+	probes := c.ProbeChecks()
+	lists := []struct {
+		name   string
+		checks []string
+	}{
+		{"health.required", health.Required},
+		{"health.degraded", health.Degraded},
+		{"health.informational", health.Informational},
+		{"probes.livez", probes.Livez},
+		{"probes.readyz", probes.Readyz},
+		{"probes.startupz", probes.Startupz},
+	}
+	for _, l := range lists {
+		for _, name := range l.checks {
+			if !slices.Contains(available, name) {
+				errs = append(errs, fmt.Errorf("%s: unknown health check: %s", l.name, name))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func flattenConfig(prefix string, v any, out map[string]string) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, x := range v {
+			if prefix != "" {
+				k = prefix + "." + k
+			}
+			flattenConfig(k, x, out)
+		}
+	case []any:
+		for i, x := range v {
+			flattenConfig(fmt.Sprintf("%s[%d]", prefix, i), x, out)
+		}
+	case nil:
+	case string:
+		if v == "" {
+			v = `""`
+		}
+		out[prefix] = v
+	default:
+		out[prefix] = fmt.Sprint(v)
+	}
+}
+
+func (c *Config) flatten() map[string]string {
+	out := make(map[string]string)
+	buf, err := yaml.Marshal(c)
+	if err != nil {
+		return out
+	}
+	var tree any
+	if yaml.Unmarshal(buf, &tree) == nil {
+		flattenConfig("", tree, out)
+	}
+	return out
+}
+
+// redacted replaces the secret values in the logs
+const redacted = "<redacted>"
+
+// secretKeyRegexp matches the flattened keys which may hold credentials, e.g. tokens in webhook URLs and headers
+var secretKeyRegexp = regexp.MustCompile(`^webhooks\[\d+\]\.(url|headers\..*)$`)
+
+// urlKeyRegexp matches the flattened keys of the node URLs which may carry credentials in the user info or the query
+var urlKeyRegexp = regexp.MustCompile(`^(url|nodes\[\d+\]\.url|references\[\d+\])$`)
+
+// redactURL hides the user info and the query values of the URL keeping the rest of it
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		if s == "" || s == `""` {
+			return s
+		}
+		return redacted
+	}
+	var b strings.Builder
+	b.WriteString(u.Scheme + "://")
+	if u.User != nil {
+		b.WriteString(redacted + "@")
+	}
+	b.WriteString(u.Host + u.EscapedPath())
+	if u.RawQuery != "" {
+		var params []string
+		for k := range u.Query() {
+			params = append(params, url.QueryEscape(k)+"="+redacted)
+		}
+		slices.Sort(params)
+		b.WriteString("?" + strings.Join(params, "&"))
+	}
+	return b.String()
+}
+
+// Diff returns the list of changed fields in form of `key: old -> new`. Secret values are redacted
+func (c *Config) Diff(other *Config) []string {
+	a, b := c.flatten(), other.flatten()
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	var out []string
+	for _, k := range keys {
+		x, okx := a[k]
+		y, oky := b[k]
+		if okx && oky && x == y {
+			continue
+		}
+		switch {
+		case secretKeyRegexp.MatchString(k):
+			x, y = redacted, redacted
+		case urlKeyRegexp.MatchString(k):
+			x, y = redactURL(x), redactURL(y)
+		}
+		if !okx {
+			x = "<none>"
+		}
+		if !oky {
+			y = "<none>"
+		}
+		out = append(out, fmt.Sprintf("%s: %s -> %s", k, x, y))
+	}
+	return out
 }
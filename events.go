@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	tz "github.com/ecadlabs/gotez/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EventHead            = "head"
+	EventHealth          = "health"
+	EventProtocolUpgrade = "protocol_upgrade"
+	EventSyncState       = "sync_state"
+	EventChainID         = "chain_id"
+	EventCheck           = "check"
+	EventReorg           = "reorg"
+)
+
+const (
+	eventSubscriberQueue = 64
+	eventKeepAlive       = 15 * time.Second
+)
+
+// Event is a single message delivered to the event stream subscribers
+type Event struct {
+	ID   uint64    `json:"id"`
+	Type string    `json:"type"`
+	Node string    `json:"node"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data"`
+}
+
+type HeadEvent struct {
+	Level     int32            `json:"level"`
+	Hash      *tz.BlockHash    `json:"hash"`
+	Timestamp time.Time        `json:"timestamp"`
+	Delay     string           `json:"delay"`
+	Protocol  *tz.ProtocolHash `json:"protocol"`
+}
+
+type HealthEvent struct {
+	From HealthState `json:"from"`
+	To   HealthState `json:"to"`
+	// Initial marks the first evaluation after the start. From is the assumed initial state in this case
+	Initial bool `json:"initial,omitempty"`
+	// Final marks the end of observations, e.g. the shutdown
+	Final bool `json:"final,omitempty"`
+}
+
+type ProtocolUpgradeEvent struct {
+	Level    int32            `json:"level"`
+	Block    *tz.BlockHash    `json:"block"`
+	Protocol *tz.ProtocolHash `json:"protocol"`
+}
+
+type SyncStateEvent struct {
+	Bootstrapped     bool   `json:"bootstrapped"`
+	SyncState        string `json:"sync_state"`
+	PrevBootstrapped bool   `json:"prev_bootstrapped"`
+	PrevSyncState    string `json:"prev_sync_state"`
+}
+
+type CheckEvent struct {
+	Name     string      `json:"name"`
+	Status   CheckStatus `json:"status"`
+	Previous CheckStatus `json:"previous"`
+	Mode     CheckMode   `json:"mode"`
+	Reason   string      `json:"reason,omitempty"`
+}
+
+type ChainIDEvent struct {
+	Expected *tz.ChainID `json:"expected"`
+	ChainID  *tz.ChainID `json:"chain_id"`
+	Mismatch bool        `json:"mismatch"`
+}
+
+// EventSink receives events produced by a node's monitors
+type EventSink interface {
+	Publish(typ string, data any)
+}
+
+// EventBus delivers events to subscribers and keeps a ring buffer of recent events for resumption
+type EventBus struct {
+	mtx  sync.Mutex
+	seq  uint64
+	buf  []*Event
+	pos  int
+	subs map[chan *Event]struct{}
+}
+
+func NewEventBus(bufferSize int) *EventBus {
+	return &EventBus{
+		buf:  make([]*Event, 0, bufferSize),
+		subs: make(map[chan *Event]struct{}),
+	}
+}
+
+func (b *EventBus) publish(ev *Event) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.seq++
+	ev.ID = b.seq
+	if cap(b.buf) != 0 {
+		if len(b.buf) < cap(b.buf) {
+			b.buf = append(b.buf, ev)
+		} else {
+			b.buf[b.pos] = ev
+			b.pos = (b.pos + 1) % len(b.buf)
+		}
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			// slow subscriber, drop it and let it resume using Last-Event-ID
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Node returns an event sink which marks events with the node name
+func (b *EventBus) Node(name string) EventSink {
+	return &nodeEventSink{bus: b, node: name}
+}
+
+type nodeEventSink struct {
+	bus  *EventBus
+	node string
+}
+
+func (s *nodeEventSink) Publish(typ string, data any) {
+	s.bus.publish(&Event{
+		Type: typ,
+		Node: s.node,
+		Time: time.Now(),
+		Data: data,
+	})
+}
+
+// Subscribe returns buffered events newer than lastID along with a channel of the new ones
+func (b *EventBus) Subscribe(lastID uint64) ([]*Event, chan *Event) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	var replay []*Event
+	if lastID != 0 {
+		if lastID > b.seq {
+			// the counter was reset by a restart
+			lastID = 0
+		}
+		for i := range b.buf {
+			ev := b.buf[(b.pos+i)%len(b.buf)]
+			if ev.ID > lastID {
+				replay = append(replay, ev)
+			}
+		}
+	}
+	ch := make(chan *Event, eventSubscriberQueue)
+	b.subs[ch] = struct{}{}
+	return replay, ch
+}
+
+func (b *EventBus) Unsubscribe(ch chan *Event) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// Subscription is a long living subscription of an internal consumer. The bus drops slow subscribers
+// in which case the subscription resubscribes and replays the missed events from the bus buffer
+type Subscription struct {
+	bus    *EventBus
+	logger log.FieldLogger
+	lastID uint64
+	ch     chan *Event
+}
+
+// NewSubscription subscribes to the events published from now on
+func (b *EventBus) NewSubscription(logger log.FieldLogger) *Subscription {
+	_, ch := b.Subscribe(0)
+	return &Subscription{bus: b, logger: logger, ch: ch}
+}
+
+// C returns the channel of the current subscription. It changes after resubscription so it must be called on each receive
+func (s *Subscription) C() <-chan *Event {
+	return s.ch
+}
+
+// Receive takes the result of a receive from C and returns the events to be processed. If the channel
+// was closed by the bus it resubscribes and returns the missed events
+func (s *Subscription) Receive(ev *Event, ok bool) []*Event {
+	if ok {
+		s.lastID = ev.ID
+		return []*Event{ev}
+	}
+	s.logger.Warn("event queue overflow, resubscribing")
+	var replay []*Event
+	replay, s.ch = s.bus.Subscribe(s.lastID)
+	if len(replay) != 0 {
+		s.lastID = replay[len(replay)-1].ID
+	}
+	return replay
+}
+
+// Drain unsubscribes and returns the queued events
+func (s *Subscription) Drain() []*Event {
+	var out []*Event
+	for {
+		select {
+		case ev, ok := <-s.ch:
+			if !ok {
+				return out
+			}
+			out = append(out, ev)
+		default:
+			s.bus.Unsubscribe(s.ch)
+			return out
+		}
+	}
+}
+
+func (s *Subscription) Close() {
+	s.bus.Unsubscribe(s.ch)
+}
+
+func writeEvent(w http.ResponseWriter, ev *Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+	return err
+}
+
+// ServeHTTP streams events using Server-Sent Events protocol. Events can be filtered using
+// `node` and `type` query parameters
+func (b *EventBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var lastID uint64
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		var err error
+		if lastID, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+	q := r.URL.Query()
+	nodes, types := q["node"], q["type"]
+	match := func(ev *Event) bool {
+		return (len(nodes) == 0 || slices.Contains(nodes, ev.Node)) && (len(types) == 0 || slices.Contains(types, ev.Type))
+	}
+
+	replay, ch := b.Subscribe(lastID)
+	defer b.Unsubscribe(ch)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, ev := range replay {
+		if match(ev) {
+			if err := writeEvent(w, ev); err != nil {
+				return
+			}
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		log.Error(err)
+		return
+	}
+
+	t := time.NewTicker(eventKeepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !match(ev) {
+				continue
+			}
+			if err := writeEvent(w, ev); err != nil {
+				return
+			}
+		case <-t.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	tz "github.com/ecadlabs/gotez/v2"
+	"github.com/ecadlabs/gotez/v2/clientv2/mempool"
+	"github.com/ecadlabs/gotez/v2/encoding"
+	"github.com/ecadlabs/gotez/v2/protocol/core"
+	"github.com/ecadlabs/gotez/v2/protocol/latest"
+	"github.com/ecadlabs/gotez/v2/protocol/proto_016_PtMumbai"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var feePercentiles = []float64{10, 25, 50, 75, 90, 99}
+
+// feeSample describes a manager operation. Batches are summed up and labelled by the last operation's kind
+type feeSample struct {
+	kind         string
+	fee          float64
+	gasLimit     float64
+	storageLimit float64
+	size         float64
+}
+
+func (s *feeSample) feePerGas() float64 {
+	return s.fee / s.gasLimit
+}
+
+func bigUintFloat(v tz.BigUint) float64 {
+	f, _ := new(big.Float).SetInt(v.Int()).Float64()
+	return f
+}
+
+// newFeeSample returns nil if the group contains no manager operations
+func newFeeSample(grp *proto_016_PtMumbai.OperationWithoutMetadata[latest.OperationContents]) *feeSample {
+	var s feeSample
+	for _, op := range grp.Operations() {
+		m, ok := op.(core.ManagerOperation)
+		if !ok {
+			continue
+		}
+		s.kind = m.OperationKind()
+		s.fee += bigUintFloat(m.GetFee())
+		s.gasLimit += bigUintFloat(m.GetGasLimit())
+		s.storageLimit += bigUintFloat(m.GetStorageLimit())
+	}
+	if s.kind == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := encoding.Encode(&buf, grp); err == nil {
+		// the branch is not a part of the group
+		s.size = float64(buf.Len() + len(tz.BlockHash{}))
+	}
+	return &s
+}
+
+// feeSnapshot is the latest state of the mempool's manager operations by pool
+type feeSnapshot struct {
+	updated time.Time
+	pools   map[string][]*feeSample
+}
+
+func appendFeeSamples(samples []*feeSample, contents []*proto_016_PtMumbai.OperationWithoutMetadata[latest.OperationContents]) []*feeSample {
+	for _, grp := range contents {
+		if s := newFeeSample(grp); s != nil {
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+func newFeeSnapshot(resp *mempool.PendingOperationsResponse) *feeSnapshot {
+	s := feeSnapshot{
+		updated: time.Now(),
+		pools:   make(map[string][]*feeSample),
+	}
+	var validated []*feeSample
+	for _, list := range resp.Validated {
+		validated = appendFeeSamples(validated, list.Contents)
+	}
+	s.pools["validated"] = validated
+	pools := map[string][]*mempool.PendingOperationsListWithError{
+		"refused":        resp.Refused,
+		"outdated":       resp.Outdated,
+		"branch_refused": resp.BranchRefused,
+		"branch_delayed": resp.BranchDelayed,
+	}
+	for name, pool := range pools {
+		var samples []*feeSample
+		for _, list := range pool {
+			samples = appendFeeSamples(samples, list.Contents)
+		}
+		s.pools[name] = samples
+	}
+	var unprocessed []*feeSample
+	for _, list := range resp.Unprocessed {
+		unprocessed = appendFeeSamples(unprocessed, list.Contents)
+	}
+	s.pools["unprocessed"] = unprocessed
+	return &s
+}
+
+type feeMetric struct {
+	desc    *prometheus.Desc
+	buckets []float64
+	value   func(*feeSample) (float64, bool)
+}
+
+// feeCollector exports the snapshot as histograms. The histograms describe the current content of the mempool
+// rather than accumulate the observations over time
+type feeCollector struct {
+	mtx      sync.RWMutex
+	snapshot *feeSnapshot
+	metrics  []*feeMetric
+}
+
+func newFeeCollector() *feeCollector {
+	labels := []string{"pool", "kind"}
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName("tezos", "node", name), help, labels, nil)
+	}
+	always := func(f func(*feeSample) float64) func(*feeSample) (float64, bool) {
+		return func(s *feeSample) (float64, bool) { return f(s), true }
+	}
+	return &feeCollector{
+		metrics: []*feeMetric{
+			{
+				desc:    desc("mempool_operation_fee_mutez", "Fees of the manager operations currently in the mempool."),
+				buckets: []float64{100, 200, 500, 1000, 2000, 5000, 10000, 20000, 50000, 100000, 1000000},
+				value:   always(func(s *feeSample) float64 { return s.fee }),
+			},
+			{
+				desc:    desc("mempool_operation_gas_limit", "Gas limits of the manager operations currently in the mempool."),
+				buckets: []float64{100, 500, 1000, 2000, 5000, 10000, 20000, 50000, 100000, 200000, 500000, 1040000},
+				value:   always(func(s *feeSample) float64 { return s.gasLimit }),
+			},
+			{
+				desc:    desc("mempool_operation_storage_limit", "Storage limits of the manager operations currently in the mempool."),
+				buckets: []float64{0, 1, 10, 100, 257, 500, 1000, 5000, 10000, 60000},
+				value:   always(func(s *feeSample) float64 { return s.storageLimit }),
+			},
+			{
+				desc:    desc("mempool_operation_size_bytes", "Sizes of the manager operations currently in the mempool."),
+				buckets: []float64{100, 200, 300, 500, 1000, 2000, 5000, 10000, 32768},
+				value:   func(s *feeSample) (float64, bool) { return s.size, s.size != 0 },
+			},
+			{
+				desc:    desc("mempool_operation_fee_per_gas_mutez", "Fees per gas unit of the manager operations currently in the mempool."),
+				buckets: []float64{0.1, 0.2, 0.5, 1, 2, 5, 10, 100},
+				value:   func(s *feeSample) (float64, bool) { return s.feePerGas(), s.gasLimit != 0 },
+			},
+		},
+	}
+}
+
+func (c *feeCollector) update(s *feeSnapshot) {
+	c.mtx.Lock()
+	c.snapshot = s
+	c.mtx.Unlock()
+}
+
+func (c *feeCollector) get() *feeSnapshot {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.snapshot
+}
+
+func (c *feeCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range c.metrics {
+		ch <- m.desc
+	}
+}
+
+func (c *feeCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.get()
+	if s == nil {
+		return
+	}
+	for pool, samples := range s.pools {
+		byKind := make(map[string][]*feeSample)
+		for _, smp := range samples {
+			byKind[smp.kind] = append(byKind[smp.kind], smp)
+		}
+		for kind, samples := range byKind {
+			for _, m := range c.metrics {
+				var (
+					count uint64
+					sum   float64
+				)
+				buckets := make(map[float64]uint64, len(m.buckets))
+				for _, smp := range samples {
+					v, ok := m.value(smp)
+					if !ok {
+						continue
+					}
+					count++
+					sum += v
+					for _, b := range m.buckets {
+						if v <= b {
+							buckets[b]++
+						}
+					}
+				}
+				ch <- prometheus.MustNewConstHistogram(m.desc, count, sum, buckets, pool, kind)
+			}
+		}
+	}
+}
+
+// percentile returns the nearest rank percentile of the sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)]
+}
+
+// FeeStats is the distribution of fees per gas unit
+type FeeStats struct {
+	Count int `json:"count"`
+	// Percentiles are keyed by names like "p50"
+	Percentiles map[string]float64 `json:"percentiles,omitempty"`
+}
+
+func newFeeStats(samples []*feeSample) *FeeStats {
+	values := make([]float64, 0, len(samples))
+	for _, s := range samples {
+		if s.gasLimit != 0 {
+			values = append(values, s.feePerGas())
+		}
+	}
+	stats := FeeStats{Count: len(values)}
+	if len(values) == 0 {
+		return &stats
+	}
+	slices.Sort(values)
+	stats.Percentiles = make(map[string]float64, len(feePercentiles))
+	for _, p := range feePercentiles {
+		stats.Percentiles["p"+strconv.FormatFloat(p, 'f', -1, 64)] = percentile(values, p)
+	}
+	return &stats
+}
+
+// PoolFees is the distribution of fees per gas unit in a single pool, overall and by operation kind
+type PoolFees struct {
+	FeeStats
+	Kinds map[string]*FeeStats `json:"kinds"`
+}
+
+// MempoolFees is the report returned by `/mempool/fees`
+type MempoolFees struct {
+	Updated time.Time            `json:"updated"`
+	Pools   map[string]*PoolFees `json:"pools"`
+}
+
+func (s *feeSnapshot) report() *MempoolFees {
+	out := MempoolFees{
+		Updated: s.updated,
+		Pools:   make(map[string]*PoolFees, len(s.pools)),
+	}
+	for pool, samples := range s.pools {
+		byKind := make(map[string][]*feeSample)
+		for _, smp := range samples {
+			byKind[smp.kind] = append(byKind[smp.kind], smp)
+		}
+		pf := PoolFees{
+			FeeStats: *newFeeStats(samples),
+			Kinds:    make(map[string]*FeeStats, len(byKind)),
+		}
+		for kind, samples := range byKind {
+			pf.Kinds[kind] = newFeeStats(samples)
+		}
+		out.Pools[pool] = &pf
+	}
+	return &out
+}
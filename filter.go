@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	FilterAllow = "allow"
+	FilterDeny  = "deny"
+)
+
+// FilterRule matches requests by method and path pattern. The pattern uses path.Match syntax,
+// a pattern ending with `/*` matches all paths below the prefix
+type FilterRule struct {
+	Name    string   `yaml:"name"`
+	Action  string   `yaml:"action"`
+	Methods []string `yaml:"methods"`
+	Path    string   `yaml:"path"`
+}
+
+// FilterConfig is an ordered list of rules. The first matching rule wins
+type FilterConfig struct {
+	Default string        `yaml:"default"`
+	Rules   []*FilterRule `yaml:"rules"`
+}
+
+// PathFilter is a middleware rejecting requests according to the rules
+type PathFilter struct {
+	cfg      FilterConfig
+	listener string
+	metric   *prometheus.CounterVec
+}
+
+func newFilterMetric(reg prometheus.Registerer) *prometheus.CounterVec {
+	m := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tezos",
+		Subsystem: "sidecar",
+		Name:      "blocked_requests_total",
+		Help:      "The total number of requests rejected by the path filter.",
+	}, []string{"listener", "rule"})
+	if reg != nil {
+		reg.MustRegister(m)
+	}
+	return m
+}
+
+func validAction(a string) bool {
+	return a == FilterAllow || a == FilterDeny
+}
+
+// New returns a filter for the listener. Blocked requests are counted by the metric
+func (c *FilterConfig) New(listener string, metric *prometheus.CounterVec) (*PathFilter, error) {
+	f := &PathFilter{
+		cfg:      *c,
+		listener: listener,
+		metric:   metric,
+	}
+	if f.cfg.Default == "" {
+		f.cfg.Default = FilterAllow
+	}
+	if !validAction(f.cfg.Default) {
+		return nil, fmt.Errorf("invalid filter action: %s", f.cfg.Default)
+	}
+	for _, r := range c.Rules {
+		if !validAction(r.Action) {
+			return nil, fmt.Errorf("invalid filter action: %s", r.Action)
+		}
+		if _, err := path.Match(r.Path, ""); err != nil {
+			return nil, fmt.Errorf("invalid path pattern %s: %w", r.Path, err)
+		}
+	}
+	return f, nil
+}
+
+func matchPath(pattern, p string) bool {
+	prefix, ok := strings.CutSuffix(pattern, "/*")
+	if !ok {
+		m, _ := path.Match(pattern, p)
+		return m
+	}
+	pp := strings.Split(prefix, "/")
+	sp := strings.Split(p, "/")
+	if len(sp) <= len(pp) {
+		return false
+	}
+	for i := range pp {
+		if m, _ := path.Match(pp[i], sp[i]); !m {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *FilterRule) match(req *http.Request) bool {
+	if len(r.Methods) != 0 && !slices.ContainsFunc(r.Methods, func(m string) bool { return strings.EqualFold(m, req.Method) }) {
+		return false
+	}
+	return r.Path == "" || matchPath(r.Path, req.URL.Path)
+}
+
+// cleanPath removes dot segments and duplicate slashes preserving the trailing slash
+func cleanPath(p string) string {
+	c := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && c != "/" {
+		c += "/"
+	}
+	return c
+}
+
+// Allow returns true if the request is allowed and the name of the matched rule
+func (f *PathFilter) Allow(req *http.Request) (bool, string) {
+	for _, r := range f.cfg.Rules {
+		if r.match(req) {
+			name := r.Name
+			if name == "" {
+				name = r.Path
+			}
+			return r.Action == FilterAllow, name
+		}
+	}
+	return f.cfg.Default == FilterAllow, "default"
+}
+
+// Handler wraps provided http.Handler with middleware
+func (f *PathFilter) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// make sure the filter and the upstream see the same path
+		if p := cleanPath(r.URL.Path); p != r.URL.Path {
+			r.URL.Path = p
+			r.URL.RawPath = ""
+		}
+		ok, rule := f.Allow(r)
+		if !ok {
+			if f.metric != nil {
+				f.metric.With(prometheus.Labels{"listener": f.listener, "rule": rule}).Inc()
+			}
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
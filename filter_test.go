@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/injection/operation", "/injection/operation", true},
+		{"/injection/operation", "/injection/operation/", false},
+		{"/chains/*/blocks", "/chains/main/blocks", true},
+		{"/chains/*/blocks", "/chains/main/blocks/head", false},
+		{"/chains/*/blocks", "/chains/main/sub/blocks", false},
+		// a `/*` pattern matches everything below the prefix but not the prefix itself
+		{"/injection/*", "/injection/operation", true},
+		{"/injection/*", "/injection/block/extra", true},
+		{"/injection/*", "/injection/", true},
+		{"/injection/*", "/injection", false},
+		{"/injection/*", "/injectionx/operation", false},
+		{"/chains/*/blocks/*", "/chains/main/blocks/head/header", true},
+		{"/chains/*/blocks/*", "/chains/main/mempool/pending_operations", false},
+		{"/*", "/anything/at/all", true},
+		// the prefix is matched segment by segment
+		{"/inj*/*", "/injection/operation", true},
+		{"/inj*/*", "/chains/injection/operation", false},
+		// the filter sees cleaned paths only, raw dot segments don't match
+		{"/injection/*", "/chains/../injection/operation", false},
+	}
+	for _, tt := range tests {
+		if got := matchPath(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchPath(%q, %q) = %t, want %t", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/chains/main/blocks", "/chains/main/blocks"},
+		{"/chains/main/blocks/", "/chains/main/blocks/"},
+		{"//injection//operation", "/injection/operation"},
+		{"/chains/main/../../injection/operation", "/injection/operation"},
+		{"/chains/./main/blocks/", "/chains/main/blocks/"},
+		{"/../../injection/operation", "/injection/operation"},
+		{"injection/operation", "/injection/operation"},
+		{"/chains/..", "/"},
+		{"/chains/../", "/"},
+	}
+	for _, tt := range tests {
+		if got := cleanPath(tt.path); got != tt.want {
+			t.Errorf("cleanPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPathFilterHandler(t *testing.T) {
+	conf := FilterConfig{
+		Rules: []*FilterRule{
+			{Action: FilterDeny, Path: "/injection/*"},
+			{Action: FilterDeny, Methods: []string{"POST"}, Path: "/chains/*/blocks/*"},
+		},
+	}
+	f, err := conf.New("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var upstream string
+	h := f.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.URL.Path
+	}))
+
+	tests := []struct {
+		method string
+		target string
+		status int
+		// upstream is the path seen by the handler if the request is allowed
+		upstream string
+	}{
+		{"GET", "/chains/main/blocks/head", http.StatusOK, "/chains/main/blocks/head"},
+		{"POST", "/chains/main/blocks/head/helpers/scripts/run_operation", http.StatusForbidden, ""},
+		{"post", "/chains/main/blocks/head/helpers/scripts/run_operation", http.StatusForbidden, ""},
+		{"POST", "/injection/operation", http.StatusForbidden, ""},
+		{"POST", "//injection/operation", http.StatusForbidden, ""},
+		{"POST", "/injection//operation", http.StatusForbidden, ""},
+		{"POST", "/chains/main/../../injection/operation", http.StatusForbidden, ""},
+		{"POST", "/chains/main/./../../injection/operation", http.StatusForbidden, ""},
+		// encoded slashes and dots are decoded before the path is cleaned
+		{"POST", "/injection%2Foperation", http.StatusForbidden, ""},
+		{"POST", "/chains/main/%2E%2E/%2E%2E/injection/operation", http.StatusForbidden, ""},
+		{"POST", "/chains/main/..%2F..%2Finjection/operation", http.StatusForbidden, ""},
+		{"POST", "/%69njection/operation", http.StatusForbidden, ""},
+		{"GET", "/chains/main/../main/blocks/head/", http.StatusOK, "/chains/main/blocks/head/"},
+	}
+	for _, tt := range tests {
+		upstream = ""
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.target, rec.Code, tt.status)
+		}
+		if upstream != tt.upstream {
+			t.Errorf("%s %s: upstream path %q, want %q", tt.method, tt.target, upstream, tt.upstream)
+		}
+	}
+}
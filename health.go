@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type CheckStatus int
+
+const (
+	CheckFail CheckStatus = iota
+	CheckPass
+	// CheckWarn means the check is passing but the observed value is close to the failure threshold
+	CheckWarn
+)
+
+func (s CheckStatus) String() string {
+	switch s {
+	case CheckPass:
+		return "pass"
+	case CheckWarn:
+		return "warn"
+	default:
+		return "fail"
+	}
+}
+
+func (s CheckStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func checkStatus(ok bool) CheckStatus {
+	if ok {
+		return CheckPass
+	}
+	return CheckFail
+}
+
+// CheckMode defines how a check affects the overall health status
+type CheckMode int
+
+const (
+	// CheckInformational checks are reported but never affect the overall status
+	CheckInformational CheckMode = iota
+	// CheckDegraded checks mark the node as degraded on failure
+	CheckDegraded
+	// CheckRequired checks mark the node as unhealthy on failure
+	CheckRequired
+)
+
+func (m CheckMode) String() string {
+	switch m {
+	case CheckRequired:
+		return "required"
+	case CheckDegraded:
+		return "degraded"
+	default:
+		return "informational"
+	}
+}
+
+func (m CheckMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// HealthState is the overall health status of a node
+type HealthState int
+
+const (
+	HealthUnhealthy HealthState = iota
+	HealthDegraded
+	HealthHealthy
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case HealthHealthy:
+		return "healthy"
+	case HealthDegraded:
+		return "degraded"
+	default:
+		return "unhealthy"
+	}
+}
+
+func (s HealthState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *HealthState) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "healthy":
+		*s = HealthHealthy
+	case "degraded":
+		*s = HealthDegraded
+	case "unhealthy":
+		*s = HealthUnhealthy
+	default:
+		return fmt.Errorf("invalid health state: %s", text)
+	}
+	return nil
+}
+
+// CheckResult is the outcome of an individual health check
+type CheckResult struct {
+	Name      string      `json:"name"`
+	Status    CheckStatus `json:"status"`
+	Mode      CheckMode   `json:"mode"`
+	Value     any         `json:"value"`
+	Threshold any         `json:"threshold,omitempty"`
+	Updated   time.Time   `json:"updated"`
+	Reason    string      `json:"reason,omitempty"`
+}
+
+// CheckMetadata contains static information about a check
+type CheckMetadata struct {
+	Description string `json:"description"`
+}
+
+// Checker is an individual health check
+type Checker interface {
+	// Name returns the unique name of the check used in the configuration
+	Name() string
+	// Evaluate returns the current result of the check
+	Evaluate() *CheckResult
+	// Metadata returns static information about the check
+	Metadata() *CheckMetadata
+}
+
+// CheckRegistry holds a set of named checks along with their modes
+type CheckRegistry struct {
+	checkers []Checker
+	modes    map[string]CheckMode
+}
+
+func NewCheckRegistry() *CheckRegistry {
+	return &CheckRegistry{
+		modes: make(map[string]CheckMode),
+	}
+}
+
+// Register adds a check. Checks are informational unless configured otherwise
+func (r *CheckRegistry) Register(c Checker) {
+	if _, ok := r.modes[c.Name()]; ok {
+		panic(fmt.Sprintf("duplicate check: %s", c.Name()))
+	}
+	r.checkers = append(r.checkers, c)
+	r.modes[c.Name()] = CheckInformational
+}
+
+// Get returns the named check or nil
+func (r *CheckRegistry) Get(name string) Checker {
+	for _, c := range r.checkers {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Configure assigns modes to the registered checks
+func (r *CheckRegistry) Configure(conf *HealthConfig) error {
+	lists := []struct {
+		names []string
+		mode  CheckMode
+	}{
+		{conf.Informational, CheckInformational},
+		{conf.Degraded, CheckDegraded},
+		{conf.Required, CheckRequired},
+	}
+	for _, l := range lists {
+		for _, name := range l.names {
+			if _, ok := r.modes[name]; !ok {
+				return fmt.Errorf("unknown health check: %s", name)
+			}
+			r.modes[name] = l.mode
+		}
+	}
+	return nil
+}
+
+// Evaluate runs all registered checks. A failure of a required check makes the node unhealthy.
+// A failure of a degraded mode check or a warning produced by any non-informational check makes the node degraded
+func (r *CheckRegistry) Evaluate() *HealthReport {
+	report := HealthReport{
+		Status: HealthHealthy,
+		Checks: make([]*CheckResult, len(r.checkers)),
+	}
+	for i, c := range r.checkers {
+		res := c.Evaluate()
+		res.Name = c.Name()
+		res.Mode = r.modes[c.Name()]
+		report.Checks[i] = res
+		if res.Status == CheckPass || res.Mode == CheckInformational {
+			continue
+		}
+		if res.Status == CheckFail && res.Mode == CheckRequired {
+			report.Status = HealthUnhealthy
+		} else {
+			report.Status = min(report.Status, HealthDegraded)
+		}
+	}
+	return &report
+}
+
+// CheckInfo describes a registered check
+type CheckInfo struct {
+	Name string    `json:"name"`
+	Mode CheckMode `json:"mode"`
+	*CheckMetadata
+}
+
+func (r *CheckRegistry) Checks() []*CheckInfo {
+	out := make([]*CheckInfo, len(r.checkers))
+	for i, c := range r.checkers {
+		out[i] = &CheckInfo{
+			Name:          c.Name(),
+			Mode:          r.modes[c.Name()],
+			CheckMetadata: c.Metadata(),
+		}
+	}
+	return out
+}
+
+// HealthReport is the verbose form of the `/health` output
+type HealthReport struct {
+	// Status is the overall status after flap damping
+	Status HealthState `json:"status"`
+	// Observed is the overall status produced by the last evaluation of the checks
+	Observed HealthState    `json:"observed"`
+	Since    time.Time      `json:"since"`
+	Checks   []*CheckResult `json:"checks"`
+}
+
+// isVerbose returns true if the verbose parameter is a true boolean value like `1` or `true`
+func isVerbose(r *http.Request) bool {
+	ok, err := strconv.ParseBool(r.URL.Query().Get("verbose"))
+	return err == nil && ok
+}
+
+func (n *Node) healthCode(s HealthState) int {
+	switch s {
+	case HealthHealthy:
+		return http.StatusOK
+	case HealthDegraded:
+		return n.state().cfg.HealthDegradedCode
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (n *Node) Health(w http.ResponseWriter, r *http.Request) {
+	report := n.tracker.Report()
+	code := n.healthCode(report.Status)
+	body := n.state().cfg.HealthDegradedBody
+	switch {
+	case isVerbose(r):
+		writeJSON(w, code, report)
+	case report.Status == HealthDegraded && body != "":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		io.WriteString(w, body)
+	case report.Status == HealthDegraded:
+		writeJSON(w, code, report.Status)
+	default:
+		writeJSON(w, code, report.Status != HealthUnhealthy)
+	}
+}
+
+func (n *Node) HealthDetails(w http.ResponseWriter, r *http.Request) {
+	report := n.tracker.Report()
+	writeJSON(w, n.healthCode(report.Status), report)
+}
+
+func (n *Node) HealthChecks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, n.state().checks.Checks())
+}
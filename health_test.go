@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsVerbose(t *testing.T) {
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"/health", false},
+		{"/health?verbose", false},
+		{"/health?verbose=", false},
+		{"/health?verbose=1", true},
+		{"/health?verbose=true", true},
+		{"/health?verbose=TRUE", true},
+		{"/health?verbose=0", false},
+		{"/health?verbose=false", false},
+		{"/health?verbose=no", false},
+		{"/health?verbose=flase", false},
+		{"/health?verbose=yes", false},
+	}
+	for _, tt := range tests {
+		if got := isVerbose(httptest.NewRequest("GET", tt.target, nil)); got != tt.want {
+			t.Errorf("isVerbose(%q) = %t, want %t", tt.target, got, tt.want)
+		}
+	}
+}
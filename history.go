@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHistoryRetention = 30 * 24 * time.Hour
+	defaultHistoryRange     = 24 * time.Hour
+	defaultHistoryLimit     = 1000
+	historyCleanupInterval  = time.Hour
+	historySegmentLayout    = "2006-01-02"
+	historySegmentExt       = ".jsonl"
+)
+
+// HistoryConfig describes the persistent event history
+type HistoryConfig struct {
+	// Path is the directory holding the history segments, one file per UTC day
+	Path      string        `yaml:"path"`
+	Retention time.Duration `yaml:"retention"`
+	// Events is the list of event types to record. Heads, health transitions and check status changes are recorded by default
+	Events []string `yaml:"events"`
+}
+
+// HistoryRecord is a single history entry
+type HistoryRecord struct {
+	Time  time.Time       `json:"time"`
+	Node  string          `json:"node"`
+	Type  string          `json:"type"`
+	Check string          `json:"check,omitempty"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// History records events to an append only log split into daily segments
+type History struct {
+	cfg    HistoryConfig
+	bus    *EventBus
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	file    *os.File
+	segment string
+}
+
+// New returns the history store consuming events from the bus
+func (c *HistoryConfig) New(bus *EventBus) (*History, error) {
+	h := &History{
+		cfg: *c,
+		bus: bus,
+	}
+	if h.cfg.Retention == 0 {
+		h.cfg.Retention = defaultHistoryRetention
+	}
+	if len(h.cfg.Events) == 0 {
+		h.cfg.Events = []string{EventHead, EventHealth, EventCheck}
+	}
+	if err := os.MkdirAll(h.cfg.Path, 0o755); err != nil {
+		return nil, fmt.Errorf("history: %w", err)
+	}
+	return h, nil
+}
+
+func (h *History) log() log.FieldLogger {
+	return log.WithField("history", h.cfg.Path)
+}
+
+// Start subscribes to the bus immediately so the events published by the nodes started next aren't missed
+func (h *History) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.done = make(chan struct{})
+	sub := h.bus.NewSubscription(h.log())
+	go h.loop(ctx, sub)
+}
+
+func (h *History) Stop(ctx context.Context) error {
+	h.cancel()
+	select {
+	case <-h.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *History) loop(ctx context.Context, sub *Subscription) {
+	t := time.NewTicker(historyCleanupInterval)
+	defer func() {
+		t.Stop()
+		if h.file != nil {
+			h.file.Close()
+		}
+		close(h.done)
+	}()
+
+	h.cleanup()
+	for {
+		select {
+		case ev, ok := <-sub.C():
+			for _, ev := range sub.Receive(ev, ok) {
+				h.record(ev)
+			}
+		case <-t.C:
+			h.cleanup()
+		case <-ctx.Done():
+			// record the events published during the shutdown
+			for _, ev := range sub.Drain() {
+				h.record(ev)
+			}
+			return
+		}
+	}
+}
+
+func (h *History) record(ev *Event) {
+	if !slices.Contains(h.cfg.Events, ev.Type) {
+		return
+	}
+	data, err := json.Marshal(ev.Data)
+	if err != nil {
+		h.log().Error(err)
+		return
+	}
+	rec := HistoryRecord{
+		Time: ev.Time.UTC(),
+		Node: ev.Node,
+		Type: ev.Type,
+		Data: data,
+	}
+	if c, ok := ev.Data.(*CheckEvent); ok {
+		rec.Check = c.Name
+	}
+	if err := h.write(&rec); err != nil {
+		h.log().Error(err)
+	}
+}
+
+func (h *History) write(rec *HistoryRecord) error {
+	segment := rec.Time.Format(historySegmentLayout)
+	if h.file == nil || segment != h.segment {
+		if h.file != nil {
+			h.file.Close()
+			h.file = nil
+		}
+		f, err := os.OpenFile(filepath.Join(h.cfg.Path, segment+historySegmentExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		h.file, h.segment = f, segment
+	}
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = h.file.Write(append(buf, '\n'))
+	return err
+}
+
+// segments returns the segment dates in chronological order
+func (h *History) segments() ([]time.Time, error) {
+	entries, err := os.ReadDir(h.cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	var out []time.Time
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), historySegmentExt)
+		if !ok || e.IsDir() {
+			continue
+		}
+		if t, err := time.Parse(historySegmentLayout, name); err == nil {
+			out = append(out, t)
+		}
+	}
+	slices.SortFunc(out, func(a, b time.Time) int { return a.Compare(b) })
+	return out, nil
+}
+
+func (h *History) segmentPath(t time.Time) string {
+	return filepath.Join(h.cfg.Path, t.Format(historySegmentLayout)+historySegmentExt)
+}
+
+// cleanup removes the segments older than the retention period
+func (h *History) cleanup() {
+	segments, err := h.segments()
+	if err != nil {
+		h.log().Error(err)
+		return
+	}
+	limit := time.Now().Add(-h.cfg.Retention)
+	for _, t := range segments {
+		if t.AddDate(0, 0, 1).After(limit) {
+			break
+		}
+		if err := os.Remove(h.segmentPath(t)); err != nil {
+			h.log().Error(err)
+		} else {
+			h.log().Debugf("segment %s removed", t.Format(historySegmentLayout))
+		}
+	}
+}
+
+// HistoryQuery selects the records. Empty lists match everything
+type HistoryQuery struct {
+	From   time.Time
+	To     time.Time
+	Nodes  []string
+	Types  []string
+	Checks []string
+}
+
+func (q *HistoryQuery) match(rec *HistoryRecord) bool {
+	return !rec.Time.Before(q.From) && rec.Time.Before(q.To) &&
+		(len(q.Nodes) == 0 || slices.Contains(q.Nodes, rec.Node)) &&
+		(len(q.Types) == 0 || slices.Contains(q.Types, rec.Type)) &&
+		(len(q.Checks) == 0 || rec.Type != EventCheck || slices.Contains(q.Checks, rec.Check))
+}
+
+// Query calls fn for every matching record in chronological order until it returns false
+func (h *History) Query(q *HistoryQuery, fn func(rec *HistoryRecord) bool) error {
+	segments, err := h.segments()
+	if err != nil {
+		return err
+	}
+	for _, t := range segments {
+		if !t.AddDate(0, 0, 1).After(q.From) || !t.Before(q.To) {
+			continue
+		}
+		more, err := h.scan(h.segmentPath(t), q, fn)
+		if err != nil {
+			return err
+		}
+		if !more {
+			break
+		}
+	}
+	return nil
+}
+
+func (h *History) scan(path string, q *HistoryQuery, fn func(rec *HistoryRecord) bool) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// removed by the cleanup
+			return true, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		var rec HistoryRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			// a partially written line
+			continue
+		}
+		if q.match(&rec) && !fn(&rec) {
+			return false, nil
+		}
+	}
+	return true, s.Err()
+}
+
+// parseHistoryTime accepts RFC 3339 timestamps, Unix time in seconds or a duration relative to now
+func parseHistoryTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(v, 0), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d.Abs()), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %s", s)
+}
+
+// ServeHTTP returns the records selected by `from`, `to`, `node`, `type`, `check` and `limit` query parameters
+func (h *History) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	q := HistoryQuery{
+		From: now.Add(-defaultHistoryRange),
+		To:   now,
+	}
+	params := r.URL.Query()
+	var err error
+	if v := params.Get("from"); v != "" {
+		if q.From, err = parseHistoryTime(v, now); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	if v := params.Get("to"); v != "" {
+		if q.To, err = parseHistoryTime(v, now); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	limit := defaultHistoryLimit
+	if v := params.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+			return
+		}
+	}
+	q.Nodes, q.Types, q.Checks = params["node"], params["type"], params["check"]
+
+	records := make([]*HistoryRecord, 0)
+	truncated := false
+	err = h.Query(&q, func(rec *HistoryRecord) bool {
+		if len(records) == limit {
+			truncated = true
+			return false
+		}
+		records = append(records, rec)
+		return true
+	})
+	if err != nil {
+		h.log().Error(err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, &struct {
+		Records   []*HistoryRecord `json:"records"`
+		Truncated bool             `json:"truncated"`
+	}{records, truncated})
+}
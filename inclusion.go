@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	tz "github.com/ecadlabs/gotez/v2"
+	client "github.com/ecadlabs/gotez/v2/clientv2"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const inclusionQueue = 16
+
+var inclusionBuckets = []float64{1, 2, 5, 10, 15, 20, 30, 45, 60, 90, 120, 180, 300, 600, 1800, 3600}
+
+type InclusionMonitorConfig struct {
+	Client  *client.Client
+	Chain   *ChainMonitor
+	Timeout time.Duration
+	Reg     prometheus.Registerer
+	Logger  log.FieldLogger
+}
+
+type pendingOperation struct {
+	kind   string
+	branch *tz.BlockHash
+	// level is the branch level, 0 until resolved
+	level int32
+	seen  time.Time
+}
+
+type inclusionHead struct {
+	hash  *tz.BlockHash
+	level int32
+	time  time.Time
+}
+
+// InclusionMonitor matches the operations seen in the mempool against the operations of new heads
+type InclusionMonitor struct {
+	cfg InclusionMonitorConfig
+
+	mtx     sync.Mutex
+	pending map[tz.OperationHash]*pendingOperation
+	// levels caches the levels of the recent heads and resolved branches
+	levels map[tz.BlockHash]int32
+	// ttl is max_operations_ttl of the current protocol, 0 if unknown
+	ttl int32
+
+	heads  chan *inclusionHead
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	latency *prometheus.HistogramVec
+	expired *prometheus.CounterVec
+}
+
+func (c *InclusionMonitorConfig) New() *InclusionMonitor {
+	m := &InclusionMonitor{
+		cfg:     *c,
+		pending: make(map[tz.OperationHash]*pendingOperation),
+		levels:  make(map[tz.BlockHash]int32),
+		heads:   make(chan *inclusionHead, inclusionQueue),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "operation_inclusion_seconds",
+			Help:      "Time between an operation's first appearance in the mempool and the arrival of the block including it.",
+			Buckets:   inclusionBuckets,
+		}, []string{"kind"}),
+		expired: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "operations_expired_total",
+			Help:      "The total number of mempool operations not included in a block before their branch expired.",
+		}, []string{"kind"}),
+	}
+	if c.Reg != nil {
+		c.Reg.MustRegister(m.latency)
+		c.Reg.MustRegister(m.expired)
+	}
+	return m
+}
+
+// inherit copies the pending operations of the replaced monitor
+func (m *InclusionMonitor) inherit(old *InclusionMonitor) {
+	old.mtx.Lock()
+	defer old.mtx.Unlock()
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	maps.Copy(m.pending, old.pending)
+	maps.Copy(m.levels, old.levels)
+	m.ttl = old.ttl
+}
+
+// Add remembers the operation first seen in the mempool
+func (m *InclusionMonitor) Add(hash *tz.OperationHash, branch *tz.BlockHash, kind string, seen time.Time) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.pending[*hash]; !ok {
+		m.pending[*hash] = &pendingOperation{kind: kind, branch: branch, seen: seen}
+	}
+}
+
+// Drop forgets the operations which won't be included, e.g. refused by the node
+func (m *InclusionMonitor) Drop(hashes []*tz.OperationHash) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, hash := range hashes {
+		delete(m.pending, *hash)
+	}
+}
+
+// SetMaxOperationsTTL sets the number of levels after which an operation's branch is too old to be included
+func (m *InclusionMonitor) SetMaxOperationsTTL(ttl int32) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.ttl = ttl
+}
+
+// NotifyHead queues the new head for the inclusion check. The head is dropped if the queue is full
+func (m *InclusionMonitor) NotifyHead(hash *tz.BlockHash, level int32) {
+	select {
+	case m.heads <- &inclusionHead{hash: hash, level: level, time: time.Now()}:
+	default:
+		m.cfg.Logger.WithField("block", hash).Warn("inclusion queue is full")
+	}
+}
+
+func (m *InclusionMonitor) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.done = make(chan struct{})
+	go m.loop(ctx)
+}
+
+func (m *InclusionMonitor) Stop(ctx context.Context) error {
+	m.cancel()
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *InclusionMonitor) loop(ctx context.Context) {
+	defer close(m.done)
+	for {
+		select {
+		case head := <-m.heads:
+			if err := m.check(ctx, head); err != nil {
+				if errors.Is(err, context.Canceled) {
+					return
+				}
+				m.cfg.Logger.Warn(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *InclusionMonitor) getOperationHashes(ctx context.Context, block *tz.BlockHash) ([][]*tz.OperationHash, error) {
+	c, cancel := context.WithTimeout(ctx, m.cfg.Timeout)
+	defer cancel()
+	var out [][]*tz.OperationHash
+	path := fmt.Sprintf("/chains/%s/blocks/%v/operation_hashes", m.cfg.Chain, block)
+	if err := getJSON(c, m.cfg.Client, path, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (m *InclusionMonitor) getBranchLevel(ctx context.Context, branch *tz.BlockHash) (int32, error) {
+	c, cancel := context.WithTimeout(ctx, m.cfg.Timeout)
+	defer cancel()
+	var out struct {
+		Level int32 `json:"level"`
+	}
+	path := fmt.Sprintf("/chains/%s/blocks/%v/header/shell", m.cfg.Chain, branch)
+	if err := getJSON(c, m.cfg.Client, path, &out); err != nil {
+		return 0, err
+	}
+	return out.Level, nil
+}
+
+// unresolved fills in the cached branch levels and returns the branches which are still unknown
+func (m *InclusionMonitor) unresolved() []*tz.BlockHash {
+	var (
+		out  []*tz.BlockHash
+		seen = make(map[tz.BlockHash]bool)
+	)
+	for _, op := range m.pending {
+		if op.level != 0 || op.branch == nil {
+			continue
+		}
+		if l, ok := m.levels[*op.branch]; ok {
+			op.level = l
+		} else if !seen[*op.branch] {
+			seen[*op.branch] = true
+			out = append(out, op.branch)
+		}
+	}
+	return out
+}
+
+func (m *InclusionMonitor) check(ctx context.Context, head *inclusionHead) error {
+	passes, err := m.getOperationHashes(ctx, head.hash)
+	if err != nil {
+		return err
+	}
+	m.mtx.Lock()
+	m.levels[*head.hash] = head.level
+	for _, pass := range passes {
+		for _, hash := range pass {
+			if op, ok := m.pending[*hash]; ok {
+				m.latency.With(prometheus.Labels{"kind": op.kind}).Observe(head.time.Sub(op.seen).Seconds())
+				delete(m.pending, *hash)
+			}
+		}
+	}
+	branches := m.unresolved()
+	m.mtx.Unlock()
+
+	// the branches are usually recent heads so only a few of them are fetched
+	levels := make(map[tz.BlockHash]int32, len(branches))
+	for _, b := range branches {
+		level, err := m.getBranchLevel(ctx, b)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return err
+			}
+			m.cfg.Logger.WithField("branch", b).Warn(err)
+			continue
+		}
+		levels[*b] = level
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	maps.Copy(m.levels, levels)
+	m.unresolved()
+	for hash, op := range m.pending {
+		var expired bool
+		if op.level != 0 && m.ttl != 0 {
+			expired = head.level > op.level+m.ttl
+		} else {
+			// the branch level or the protocol's max_operations_ttl is unknown
+			expired = head.time.Sub(op.seen) > operationTTL
+		}
+		if expired {
+			m.expired.With(prometheus.Labels{"kind": op.kind}).Inc()
+			delete(m.pending, hash)
+		}
+	}
+	if m.ttl != 0 {
+		for b, level := range m.levels {
+			if head.level > level+m.ttl {
+				delete(m.levels, b)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	tz "github.com/ecadlabs/gotez/v2"
+	client "github.com/ecadlabs/gotez/v2/clientv2"
+	"github.com/ecadlabs/gotez/v2/clientv2/block"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// finalityDepth is the number of the most recent levels whose blocks may still be replaced by a higher round block
+const finalityDepth = 2
+
+type LagMonitorConfig struct {
+	Client      *client.Client
+	References  []*client.Client
+	Chain       *ChainMonitor
+	Timeout     time.Duration
+	Interval    time.Duration
+	MaxLevelLag int32
+	Reg         prometheus.Registerer
+	Logger      log.FieldLogger
+}
+
+// LagStatus is the result of the comparison of the local head against reference nodes
+type LagStatus struct {
+	Level          int32         `json:"level"`
+	Hash           *tz.BlockHash `json:"hash"`
+	ReferenceLevel int32         `json:"reference_level"`
+	Lag            int32         `json:"lag"`
+	Forked         bool          `json:"forked"`
+	// ForkLevel is the level of the mismatching blocks
+	ForkLevel int32 `json:"fork_level,omitempty"`
+}
+
+// LagMonitor periodically compares the local head level and hash against reference nodes
+type LagMonitor struct {
+	cfg LagMonitorConfig
+
+	mtx     sync.RWMutex
+	status  LagStatus
+	ok      bool
+	updated time.Time
+	err     error
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	lagGauge    prometheus.Gauge
+	forkedGauge prometheus.Gauge
+}
+
+func (c *LagMonitorConfig) New() *LagMonitor {
+	m := &LagMonitor{
+		cfg: *c,
+		lagGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "head_level_lag",
+			Help:      "The number of levels the local head is behind the most advanced reference node.",
+		}),
+		forkedGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "head_forked",
+			Help:      "Returns 1 if a final local block hash differs from the one of a reference node at the same level.",
+		}),
+	}
+	if c.Reg != nil {
+		c.Reg.MustRegister(m.lagGauge)
+		c.Reg.MustRegister(m.forkedGauge)
+	}
+	return m
+}
+
+// inherit copies the last observed state of the replaced monitor
+func (l *LagMonitor) inherit(old *LagMonitor) {
+	old.mtx.RLock()
+	defer old.mtx.RUnlock()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.status, l.ok, l.updated, l.err = old.status, old.ok, old.updated, old.err
+}
+
+func (l *LagMonitor) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel = cancel
+	l.done = make(chan struct{})
+	go l.loop(ctx)
+}
+
+func (l *LagMonitor) Stop(ctx context.Context) error {
+	l.cancel()
+	select {
+	case <-l.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status returns the last observed lag status and true if the lag is within the limit
+func (l *LagMonitor) Status() (LagStatus, bool) {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	return l.status, l.ok
+}
+
+// LastUpdate returns the time of the last successful poll and the last poll error, if any
+func (l *LagMonitor) LastUpdate() (time.Time, error) {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	return l.updated, l.err
+}
+
+func (l *LagMonitor) loop(ctx context.Context) {
+	t := time.NewTicker(l.cfg.Interval)
+	defer func() {
+		t.Stop()
+		close(l.done)
+	}()
+
+	for {
+		err := l.poll(ctx)
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		l.mtx.Lock()
+		l.err = err
+		l.mtx.Unlock()
+		if err != nil {
+			l.cfg.Logger.Warn(err)
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *LagMonitor) getHead(ctx context.Context, cl *client.Client) (*tz.BlockHash, int32, error) {
+	c, cancel := context.WithTimeout(ctx, l.cfg.Timeout)
+	defer cancel()
+	hash, err := block.Hash(c, cl, &block.SimpleRequest{
+		Chain: l.cfg.Chain.String(),
+		Block: "head",
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sh, err := block.ShellHeader(c, cl, &block.SimpleRequest{
+		Chain: l.cfg.Chain.String(),
+		Block: hash.String(),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return hash, sh.Level, nil
+}
+
+func (l *LagMonitor) getHash(ctx context.Context, cl *client.Client, level int32) (*tz.BlockHash, error) {
+	c, cancel := context.WithTimeout(ctx, l.cfg.Timeout)
+	defer cancel()
+	return block.Hash(c, cl, &block.SimpleRequest{
+		Chain: l.cfg.Chain.String(),
+		Block: strconv.FormatInt(int64(level), 10),
+	})
+}
+
+// compare returns the reference head level and the level at which the reference node has a different block, 0 if none.
+// Only final blocks are compared as the ones at the head level and below may still change their round
+func (l *LagMonitor) compare(ctx context.Context, ref *client.Client, level int32) (int32, int32, error) {
+	_, refLevel, err := l.getHead(ctx, ref)
+	if err != nil {
+		return 0, 0, err
+	}
+	final := min(level, refLevel) - finalityDepth
+	if final <= 0 {
+		return refLevel, 0, nil
+	}
+	localHash, err := l.getHash(ctx, l.cfg.Client, final)
+	if err != nil {
+		return 0, 0, err
+	}
+	refHash, err := l.getHash(ctx, ref, final)
+	if err != nil {
+		return 0, 0, err
+	}
+	if *localHash != *refHash {
+		return refLevel, final, nil
+	}
+	return refLevel, 0, nil
+}
+
+func (l *LagMonitor) poll(ctx context.Context) error {
+	hash, level, err := l.getHead(ctx, l.cfg.Client)
+	if err != nil {
+		l.mtx.Lock()
+		l.ok = false
+		l.mtx.Unlock()
+		return err
+	}
+
+	status := LagStatus{
+		Level: level,
+		Hash:  hash,
+	}
+	var (
+		errs    []error
+		replied bool
+	)
+	for _, ref := range l.cfg.References {
+		refLevel, forkLevel, err := l.compare(ctx, ref, level)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return err
+			}
+			errs = append(errs, err)
+			continue
+		}
+		if forkLevel != 0 {
+			l.cfg.Logger.WithFields(log.Fields{"reference": ref.URL, "level": forkLevel}).Warn("block hash mismatch")
+			status.Forked = true
+			status.ForkLevel = max(status.ForkLevel, forkLevel)
+		}
+		replied = true
+		status.ReferenceLevel = max(status.ReferenceLevel, refLevel)
+	}
+	if !replied {
+		// don't penalize the node for the reference nodes' unavailability
+		l.mtx.Lock()
+		l.status.Level = level
+		l.status.Hash = hash
+		l.ok = true
+		l.updated = time.Now()
+		l.mtx.Unlock()
+		return errors.Join(errs...)
+	}
+	status.Lag = max(status.ReferenceLevel-level, 0)
+	ok := !status.Forked && status.Lag <= l.cfg.MaxLevelLag
+
+	l.mtx.Lock()
+	l.status = status
+	l.ok = ok
+	l.updated = time.Now()
+	l.mtx.Unlock()
+
+	l.lagGauge.Set(float64(status.Lag))
+	v := 0.0
+	if status.Forked {
+		v = 1
+	}
+	l.forkedGauge.Set(v)
+	return errors.Join(errs...)
+}
+
+func (l *LagMonitor) Name() string {
+	return "head_lag"
+}
+
+func (l *LagMonitor) Metadata() *CheckMetadata {
+	return &CheckMetadata{
+		Description: "The local head is on the same branch and not too far behind the reference nodes",
+	}
+}
+
+func (l *LagMonitor) Evaluate() *CheckResult {
+	s, ok := l.Status()
+	updated, err := l.LastUpdate()
+	res := CheckResult{
+		Status:    checkStatus(ok),
+		Value:     s.Lag,
+		Threshold: l.cfg.MaxLevelLag,
+		Updated:   updated,
+	}
+	switch {
+	case ok:
+	case err != nil:
+		res.Reason = err.Error()
+	case updated.IsZero():
+		res.Reason = "head level lag is not known yet"
+	case s.Forked:
+		res.Reason = fmt.Sprintf("the block at level %d differs from the reference one", s.ForkLevel)
+	default:
+		res.Reason = fmt.Sprintf("the node is %d levels behind the reference node at level %d", s.Lag, s.ReferenceLevel)
+	}
+	return &res
+}
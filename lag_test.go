@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	tz "github.com/ecadlabs/gotez/v2"
+	client "github.com/ecadlabs/gotez/v2/clientv2"
+	"github.com/ecadlabs/gotez/v2/encoding"
+	"github.com/ecadlabs/gotez/v2/protocol/core"
+	log "github.com/sirupsen/logrus"
+)
+
+// testChainServer serves the head and the block hashes of the chain given by the names of the blocks starting at level 1
+func testChainServer(t *testing.T, blocks ...string) *client.Client {
+	hashes := make(map[string]*tz.BlockHash, len(blocks)+1)
+	for i, name := range blocks {
+		hashes[fmt.Sprint(i+1)] = testBlockHash(name)
+	}
+	head := testBlockHash(blocks[len(blocks)-1])
+	hashes["head"] = head
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var out any
+		block, res := path.Split(strings.TrimPrefix(r.URL.Path, "/chains/main/blocks/"))
+		block = strings.TrimSuffix(block, "/")
+		switch {
+		case res == "hash" && hashes[block] != nil:
+			out = hashes[block]
+		case res == "shell" && block == head.String()+"/header":
+			out = &core.ShellHeader{
+				Level:          int32(len(blocks)),
+				Predecessor:    testBlockHash(blocks[max(len(blocks)-2, 0)]),
+				OperationsHash: &tz.OperationsHash{},
+				Context:        &tz.ContextHash{},
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		var buf bytes.Buffer
+		if err := encoding.Encode(&buf, out, encoding.Dynamic()); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	return &client.Client{URL: srv.URL}
+}
+
+func TestLagMonitorCompare(t *testing.T) {
+	tests := []struct {
+		name      string
+		local     []string
+		ref       []string
+		refLevel  int32
+		forkLevel int32
+	}{
+		{
+			name:     "same chain",
+			local:    []string{"a1", "a2", "a3", "a4", "a5"},
+			ref:      []string{"a1", "a2", "a3", "a4", "a5"},
+			refLevel: 5,
+		},
+		{
+			name:     "round change at the head level",
+			local:    []string{"a1", "a2", "a3", "a4", "a5"},
+			ref:      []string{"a1", "a2", "a3", "a4", "b5"},
+			refLevel: 5,
+		},
+		{
+			name:     "round change below the head level",
+			local:    []string{"a1", "a2", "a3", "a4", "a5"},
+			ref:      []string{"a1", "a2", "a3", "b4", "b5"},
+			refLevel: 5,
+		},
+		{
+			name:     "round change below the reference head",
+			local:    []string{"a1", "a2", "a3", "a4"},
+			ref:      []string{"a1", "a2", "a3", "b4", "b5", "b6"},
+			refLevel: 6,
+		},
+		{
+			name:     "reference node behind",
+			local:    []string{"a1", "a2", "a3", "a4", "a5", "a6"},
+			ref:      []string{"a1", "a2", "a3", "b4"},
+			refLevel: 4,
+		},
+		{
+			name:      "fork at a final level",
+			local:     []string{"a1", "a2", "a3", "a4", "a5"},
+			ref:       []string{"a1", "a2", "b3", "b4", "b5"},
+			refLevel:  5,
+			forkLevel: 3,
+		},
+		{
+			name:      "fork below the local head",
+			local:     []string{"a1", "a2", "a3"},
+			ref:       []string{"b1", "b2", "b3", "b4", "b5"},
+			refLevel:  5,
+			forkLevel: 1,
+		},
+		{
+			name:     "young chain",
+			local:    []string{"a1", "a2"},
+			ref:      []string{"b1", "b2"},
+			refLevel: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local := testChainServer(t, tt.local...)
+			chain := (&ChainMonitorConfig{Client: local, Timeout: time.Second, Interval: time.Hour, Logger: log.StandardLogger()}).New()
+			m := (&LagMonitorConfig{Client: local, Chain: chain, Timeout: time.Second, Logger: log.StandardLogger()}).New()
+			refLevel, forkLevel, err := m.compare(context.Background(), testChainServer(t, tt.ref...), int32(len(tt.local)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if refLevel != tt.refLevel || forkLevel != tt.forkLevel {
+				t.Errorf("reference level %d, fork level %d, want %d, %d", refLevel, forkLevel, tt.refLevel, tt.forkLevel)
+			}
+		})
+	}
+}
@@ -18,6 +18,11 @@ func (rw *responseWriter) WriteHeader(s int) {
 	rw.ResponseWriter.WriteHeader(s)
 }
 
+// Unwrap is used by http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func (rw *responseWriter) Write(data []byte) (int, error) {
 	if rw.status == 0 {
 		rw.status = http.StatusOK
@@ -3,31 +3,23 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"flag"
 
-	"github.com/ecadlabs/gotez/v2"
-	client "github.com/ecadlabs/gotez/v2/clientv2"
-	"github.com/ecadlabs/gotez/v2/clientv2/utils"
 	"github.com/gorilla/mux"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
-	"gopkg.in/yaml.v3"
 )
 
-const (
-	defaultListen         = ":8080"
-	defaultTimeout        = 30 * time.Second
-	defaultTolerance      = 1 * time.Second
-	defaultReconnectDelay = 10 * time.Second
-	defaultPollInterval   = 15 * time.Second
-)
+// shutdownTimeout limits the graceful shutdown of the listeners and the monitors
+const shutdownTimeout = 10 * time.Second
 
 type debugLogger log.Logger
 
@@ -35,9 +27,35 @@ func (l *debugLogger) Printf(format string, a ...any) {
 	(*log.Logger)(l).Debugf(format, a...)
 }
 
+// newServer returns a server cancelling the requests in flight on shutdown. Shutdown doesn't do it itself,
+// so streaming handlers like /events would never return
+func newServer(addr string, h http.Handler) *http.Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := &http.Server{
+		Handler:     h,
+		Addr:        addr,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	srv.RegisterOnShutdown(cancel)
+	return srv
+}
+
+func serve(srv *http.Server) {
+	log.Infof("Listening on %s", srv.Addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error(err)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "check-config" || os.Args[1] == "validate") {
+		os.Exit(checkConfig(os.Args[1], os.Args[2:]))
+	}
+
 	logLevel := flag.String("l", "info", "Log level: [error, warn, info, debug, trace]")
-	confPath := flag.String("c", "", "Config file path")
+	var src ConfigSource
+	flag.StringVar(&src.Path, "c", "", "Config file path")
+	src.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	ll, err := log.ParseLevel(*logLevel)
@@ -46,135 +64,68 @@ func main() {
 	}
 	log.SetLevel(ll)
 
-	conf := Config{
-		Listen:                defaultListen,
-		Timeout:               defaultTimeout,
-		Tolerance:             defaultTolerance,
-		ReconnectDelay:        defaultReconnectDelay,
-		HealthUseBlockDelay:   true,
-		HealthUseBootstrapped: true,
-		PollInterval:          defaultPollInterval,
-	}
-
-	buf, err := os.ReadFile(*confPath)
+	conf, err := src.Load()
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err := yaml.Unmarshal(buf, &conf); err != nil {
+	// the credentials in URLs and webhook headers are redacted by the MarshalJSON methods
+	var tmp strings.Builder
+	enc := json.NewEncoder(&tmp)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "    ")
+	enc.Encode(conf)
+	log.Info(tmp.String())
+
+	if err := conf.Validate(); err != nil {
 		log.Fatal(err)
 	}
-	tmp, _ := json.MarshalIndent(&conf, "", "    ")
-	log.Info(string(tmp))
 
-	cl := client.Client{
-		URL:         conf.URL,
-		DebugLogger: (*debugLogger)(log.StandardLogger()),
-	}
-
-	reg := prometheus.NewRegistry()
-
-	hmon, err := (&HeadMonitorConfig{
-		Client:         &cl,
-		ChainID:        conf.ChainID,
-		Timeout:        conf.Timeout,
-		Tolerance:      conf.Tolerance,
-		ReconnectDelay: conf.ReconnectDelay,
-		UseTimestamps:  conf.UseTimestamps,
-		Reg:            reg,
-	}).New(context.Background())
+	sc, err := NewSidecar(context.Background(), &src, conf)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	nextProto := func() *gotez.ProtocolHash { _, p := hmon.Protocols(); return p }
-
-	mmon := (&MempoolMonitorConfig{
-		Client:           &cl,
-		ChainID:          conf.ChainID,
-		Timeout:          conf.Timeout,
-		ReconnectDelay:   conf.ReconnectDelay,
-		Reg:              reg,
-		NextProtocolFunc: nextProto,
-	}).New()
-
-	poller := (&PollerConfig{
-		Client:           &cl,
-		ChainID:          conf.ChainID,
-		Timeout:          conf.Timeout,
-		Interval:         conf.PollInterval,
-		Reg:              reg,
-		NextProtocolFunc: nextProto,
-	}).New()
-
-	hmon.Start()
-	defer hmon.Stop(context.Background())
-
-	poller.Start()
-	defer poller.Stop(context.Background())
-
-	mmon.Start()
-	defer mmon.Stop(context.Background())
-
-	r := mux.NewRouter()
-	r.Methods("GET").Path("/health").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		status := true
-		if conf.HealthUseBootstrapped {
-			s := poller.Status()
-			status = status && s.Bootstrapped && s.SyncState == utils.SyncStateSynced
-		}
-		if conf.HealthUseBlockDelay {
-			status = status && hmon.Status()
+	sc.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := sc.Stop(ctx); err != nil {
+			log.Error(err)
 		}
+	}()
 
-		var code int
-		if status {
-			code = http.StatusOK
-		} else {
-			code = http.StatusInternalServerError
-		}
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(code)
-		json.NewEncoder(w).Encode(status)
-	})
-	r.Methods("GET").Path("/sync_status").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		status := poller.Status()
-		var code int
-		if status.Bootstrapped && status.SyncState == utils.SyncStateSynced {
-			code = http.StatusOK
-		} else {
-			code = http.StatusInternalServerError
-		}
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(code)
-		json.NewEncoder(w).Encode(status)
-	})
-	r.Methods("GET").Path("/block_delay").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		status := hmon.Status()
-		var code int
-		if status {
-			code = http.StatusOK
-		} else {
-			code = http.StatusInternalServerError
-		}
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(code)
-		json.NewEncoder(w).Encode(status)
-	})
-	r.Methods("GET").Path("/metrics").Handler(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	r := mux.NewRouter()
+	sc.RegisterRoutes(r)
 	r.Use((&Logging{}).Handler)
-
-	srv := &http.Server{
-		Handler: r,
-		Addr:    conf.Listen,
+	r.Use(sc.Filter)
+
+	servers := []*http.Server{newServer(conf.Listen, r)}
+	if conf.AdminListen != "" {
+		ar := mux.NewRouter()
+		sc.RegisterAdminRoutes(ar)
+		ar.Use((&Logging{}).Handler)
+		servers = append(servers, newServer(conf.AdminListen, ar))
+	}
+	for _, srv := range servers {
+		go serve(srv)
 	}
-	go func() {
-		log.Infof("Listening on %s", conf.Listen)
-		srv.ListenAndServe()
-	}()
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, unix.SIGINT, unix.SIGTERM)
-	<-c
+	signal.Notify(c, unix.SIGINT, unix.SIGTERM, unix.SIGHUP)
+	for sig := range c {
+		if sig != unix.SIGHUP {
+			break
+		}
+		log.Info("reloading configuration")
+		if _, err := sc.Reload(context.Background()); err != nil {
+			log.Errorf("reload failed: %v", err)
+		}
+	}
 
-	srv.Shutdown(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Error(err)
+		}
+	}
 }
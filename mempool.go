@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"maps"
+	"sync"
 	"time"
 
 	tz "github.com/ecadlabs/gotez/v2"
@@ -13,13 +15,20 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// operationTTL is the longest time an operation may stay in the mempool.
+// It exceeds max_operations_ttl of all protocols so far
+const operationTTL = 2 * time.Hour
+
 type MempoolMonitorConfig struct {
 	Client           *client.Client
-	ChainID          *tz.ChainID
+	Chain            *ChainMonitor
 	Timeout          time.Duration
-	ReconnectDelay   time.Duration
+	Reconnect        Backoff
 	Reg              prometheus.Registerer
 	NextProtocolFunc func() *tz.ProtocolHash
+	// Inclusion receives the new operations if not nil
+	Inclusion *InclusionMonitor
+	Logger    log.FieldLogger
 }
 
 func (c *MempoolMonitorConfig) New() *MempoolMonitor {
@@ -29,20 +38,35 @@ func (c *MempoolMonitorConfig) New() *MempoolMonitor {
 			Namespace: "tezos",
 			Subsystem: "node",
 			Name:      "mempool_operations_total",
-			Help:      "The total number of mempool operations. Resets on reconnection.",
+			Help:      "The total number of distinct operations seen in the mempool.",
 		}, []string{"kind", "proto"}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "mempool_monitor_reconnects_total",
+			Help:      "The total number of mempool monitor reconnections.",
+		}),
+		seen: make(map[tz.OperationHash]time.Time),
 	}
 	if c.Reg != nil {
 		c.Reg.MustRegister(m.metric)
+		c.Reg.MustRegister(m.reconnects)
 	}
 	return m
 }
 
 type MempoolMonitor struct {
-	cfg    MempoolMonitorConfig
-	cancel context.CancelFunc
-	done   chan struct{}
-	metric *prometheus.CounterVec
+	cfg        MempoolMonitorConfig
+	cancel     context.CancelFunc
+	done       chan struct{}
+	metric     *prometheus.CounterVec
+	reconnects prometheus.Counter
+
+	mtx sync.Mutex
+	// seen holds the time the operation was last announced. The node announces the whole mempool
+	// on each connection so the known operations are not counted again
+	seen   map[tz.OperationHash]time.Time
+	pruned time.Time
 }
 
 func (h *MempoolMonitor) Start() {
@@ -62,27 +86,71 @@ func (h *MempoolMonitor) Stop(ctx context.Context) error {
 	}
 }
 
+// inherit copies the set of known operations of the replaced monitor
+func (h *MempoolMonitor) inherit(old *MempoolMonitor) {
+	old.mtx.Lock()
+	defer old.mtx.Unlock()
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.seen, h.pruned = maps.Clone(old.seen), old.pruned
+}
+
+// observe returns true if the operation wasn't announced recently
+func (h *MempoolMonitor) observe(hash *tz.OperationHash) bool {
+	now := time.Now()
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if now.Sub(h.pruned) > operationTTL/2 {
+		for k, t := range h.seen {
+			if now.Sub(t) > operationTTL {
+				delete(h.seen, k)
+			}
+		}
+		h.pruned = now
+	}
+	_, ok := h.seen[*hash]
+	h.seen[*hash] = now
+	return !ok
+}
+
+func (h *MempoolMonitor) resolveChain(ctx context.Context) (*tz.ChainID, error) {
+	c, cancel := context.WithTimeout(ctx, h.cfg.Timeout)
+	defer cancel()
+	return h.cfg.Chain.Resolve(c)
+}
+
 func (h *MempoolMonitor) serve(ctx context.Context) {
 	defer close(h.done)
-	var err error
-	for {
+	var (
+		err error
+		// attempt is the number of consecutive failed connections
+		attempt int
+	)
+	for first := true; ; first = false {
 		if err != nil {
-			log.Error(err)
-			t := time.After(h.cfg.ReconnectDelay)
-			select {
-			case <-t:
-			case <-ctx.Done():
+			h.cfg.Logger.Error(err)
+			if !h.cfg.Reconnect.Wait(ctx, attempt) {
 				return
 			}
+			attempt++
+		}
+		if !first {
+			h.reconnects.Inc()
 		}
-
-		h.metric.Reset()
 
 		var (
-			stream <-chan *mempool.MonitorResponse
-			errCh  <-chan error
+			chainID *tz.ChainID
+			stream  <-chan *mempool.MonitorResponse
+			errCh   <-chan error
 		)
-		stream, errCh, err = mempool.Monitor(ctx, h.cfg.Client, h.cfg.ChainID)
+		chainID, err = h.resolveChain(ctx)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			continue
+		}
+		stream, errCh, err = mempool.Monitor(ctx, h.cfg.Client, chainID)
 		if err != nil {
 			if errors.Is(err, context.Canceled) {
 				return
@@ -100,18 +168,28 @@ func (h *MempoolMonitor) serve(ctx context.Context) {
 				break Recv
 
 			case resp := <-stream:
-				counter := h.metric.MustCurryWith(prometheus.Labels{"proto": h.cfg.NextProtocolFunc().String()})
+				attempt = 0
+				counter := h.metric.MustCurryWith(prometheus.Labels{"proto": protocolLabel(h.cfg.NextProtocolFunc())})
 				if log.GetLevel() >= log.DebugLevel {
 					buf, _ := json.MarshalIndent(resp.Contents, "", "    ")
-					log.Debug(string(buf))
+					h.cfg.Logger.Debug(string(buf))
 				}
 
 				for _, list := range resp.Contents {
+					if list.Hash != nil && !h.observe(list.Hash) {
+						continue
+					}
+					// a batch is labelled by its last operation as the preceding ones are usually reveals
+					var kind string
 					for _, grp := range list.Contents {
 						for _, op := range grp.Operations() {
-							counter.With(prometheus.Labels{"kind": op.OperationKind()}).Inc()
+							kind = op.OperationKind()
+							counter.With(prometheus.Labels{"kind": kind}).Inc()
 						}
 					}
+					if h.cfg.Inclusion != nil && list.Hash != nil && kind != "" {
+						h.cfg.Inclusion.Add(list.Hash, list.Branch, kind, time.Now())
+					}
 				}
 			}
 		}
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math"
 	"sync"
 	"time"
 
@@ -16,16 +18,33 @@ import (
 )
 
 type HeadMonitorConfig struct {
-	Client         *client.Client
-	ChainID        *tz.ChainID
-	Timeout        time.Duration
-	Tolerance      time.Duration
-	ReconnectDelay time.Duration
-	UseTimestamps  bool
-	Reg            prometheus.Registerer
+	Client            *client.Client
+	Chain             *ChainMonitor
+	Timeout           time.Duration
+	Tolerance         time.Duration
+	DegradedTolerance time.Duration
+	Reconnect         Backoff
+	UseTimestamps     bool
+	// ReorgWindow is the number of recent blocks kept to find the common ancestor on reorganization
+	ReorgWindow int
+	// MaxReorgDepth is the depth of a reorganization failing the reorg check for ReorgHold. 0 disables the check
+	MaxReorgDepth int32
+	ReorgHold     time.Duration
+	// StallFactor is the multiple of minimal_block_delay after which the heads stream is considered stalled
+	// if the level doesn't increase. 0 disables the watchdog
+	StallFactor float64
+	// Inclusion is notified about the new heads if not nil
+	Inclusion *InclusionMonitor
+	Reg       prometheus.Registerer
+	Logger    log.FieldLogger
+	Events    EventSink
 }
 
-func (c *HeadMonitorConfig) New(ctx context.Context) (*HeadMonitor, error) {
+// blockIntervalBuckets cover the block times of all protocols so far
+var blockIntervalBuckets = []float64{1, 2, 4, 6, 8, 10, 12, 15, 20, 30, 45, 60, 120, 300}
+
+// New returns a monitor without making any requests. The protocols are fetched along with the head once it's started
+func (c *HeadMonitorConfig) New() *HeadMonitor {
 	m := &HeadMonitor{
 		cfg: *c,
 		metric: prometheus.NewGauge(prometheus.GaugeOpts{
@@ -34,44 +53,125 @@ func (c *HeadMonitorConfig) New(ctx context.Context) (*HeadMonitor, error) {
 			Name:      "block_delay_ok",
 			Help:      "Returns 1 if the last block arrived in time.",
 		}),
+		intervalHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "block_interval_seconds",
+			Help:      "Time between consecutive heads measured by their arrival (source=\"arrival\") or their timestamps (source=\"timestamp\").",
+			Buckets:   blockIntervalBuckets,
+		}, []string{"source"}),
+		levelGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "head_level",
+			Help:      "Level of the last observed head.",
+		}),
+		minDelayGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "minimal_block_delay_seconds",
+			Help:      "The minimal_block_delay constant of the current protocol.",
+		}, []string{"proto"}),
+		reorgCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "reorgs_total",
+			Help:      "Number of chain reorganizations, i.e. new heads not descending from the previous one.",
+		}),
+		stallCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "head_stalls_total",
+			Help:      "Number of times the heads stream was reconnected because the level didn't increase in time.",
+		}),
+		reorgHistogram: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "reorg_depth",
+			Help:      "Number of blocks removed from the main branch by a reorganization.",
+			Buckets:   reorgDepthBuckets,
+		}),
 	}
+	headAge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "tezos",
+		Subsystem: "node",
+		Name:      "head_age_seconds",
+		Help:      "Time since the last head arrived. NaN if no heads were observed yet.",
+	}, func() float64 {
+		s := m.HeadStatus()
+		if s.Updated.IsZero() {
+			return math.NaN()
+		}
+		return time.Since(s.Updated).Seconds()
+	})
 	if c.Reg != nil {
-		c.Reg.MustRegister(m.metric)
-	}
-
-	bi, err := m.getBlockInfo(ctx, "head")
-	if err != nil {
-		return nil, err
+		c.Reg.MustRegister(m.metric, m.intervalHistogram, m.levelGauge, m.minDelayGauge, headAge, m.reorgCounter, m.reorgHistogram, m.stallCounter)
 	}
-	m.protocol = bi.Protocol
-	m.nextProtocol = bi.NextProtocol
+	return m
+}
 
-	return m, nil
+// HeadStatus describes the last observed head
+type HeadStatus struct {
+	OK bool `json:"ok"`
+	// Late is true if the block arrived after MaxDelay but within the degraded tolerance
+	Late     bool          `json:"late"`
+	Level    int32         `json:"level"`
+	Hash     *tz.BlockHash `json:"hash"`
+	Delay    time.Duration `json:"delay"`
+	MaxDelay time.Duration `json:"max_delay"`
+	Updated  time.Time     `json:"updated"`
+	Error    string        `json:"error,omitempty"`
 }
 
 type HeadMonitor struct {
 	cfg          HeadMonitorConfig
 	mtx          sync.RWMutex
-	status       bool
+	status       HeadStatus
 	protocol     *tz.ProtocolHash
 	nextProtocol *tz.ProtocolHash
-	cancel       context.CancelFunc
-	done         chan struct{}
-	metric       prometheus.Gauge
+	// chain is the window of recent blocks of the main branch
+	chain     []*chainBlock
+	lastReorg *Reorg
+	// deepReorg is the last reorganization deeper than MaxReorgDepth
+	deepReorg *Reorg
+	cancel    context.CancelFunc
+	done      chan struct{}
+	metric    prometheus.Gauge
+
+	intervalHistogram *prometheus.HistogramVec
+	levelGauge        prometheus.Gauge
+	minDelayGauge     *prometheus.GaugeVec
+	reorgCounter      prometheus.Counter
+	reorgHistogram    prometheus.Histogram
+	stallCounter      prometheus.Counter
 }
 
 func (h *HeadMonitor) Status() bool {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	return h.status.OK
+}
+
+// HeadStatus returns the details of the last observed head
+func (h *HeadMonitor) HeadStatus() HeadStatus {
 	h.mtx.RLock()
 	defer h.mtx.RUnlock()
 	return h.status
 }
 
+// Protocols returns the current and the next protocols of the head. Both are nil until the first head is fetched
 func (h *HeadMonitor) Protocols() (proto, next *tz.ProtocolHash) {
 	h.mtx.RLock()
 	defer h.mtx.RUnlock()
 	return h.protocol, h.nextProtocol
 }
 
+func (h *HeadMonitor) publish(typ string, data any) {
+	if h.cfg.Events != nil {
+		h.cfg.Events.Publish(typ, data)
+	}
+}
+
 func (h *HeadMonitor) context(ctx context.Context) (context.Context, context.CancelFunc) {
 	return context.WithTimeout(ctx, h.cfg.Timeout)
 }
@@ -80,7 +180,7 @@ func (h *HeadMonitor) getMinBlockDelay(c context.Context, b string, protocol *tz
 	ctx, cancel := h.context(c)
 	defer cancel()
 	consts, err := block.Constants(ctx, h.cfg.Client, &block.ContextRequest{
-		Chain:    h.cfg.ChainID.String(),
+		Chain:    h.cfg.Chain.String(),
 		Block:    b,
 		Protocol: protocol,
 	})
@@ -88,7 +188,12 @@ func (h *HeadMonitor) getMinBlockDelay(c context.Context, b string, protocol *tz
 		return 0, err
 	}
 	delay := time.Duration(consts.GetMinimalBlockDelay()) * time.Second
-	log.Debugf("%s delay = %v", b, delay)
+	h.cfg.Logger.Debugf("%s delay = %v", b, delay)
+	if h.cfg.Inclusion != nil {
+		h.cfg.Inclusion.SetMaxOperationsTTL(int32(consts.GetMaxOperationsTimeToLive()))
+	}
+	h.minDelayGauge.Reset()
+	h.minDelayGauge.With(prometheus.Labels{"proto": protocol.String()}).Set(delay.Seconds())
 	return delay, nil
 }
 
@@ -96,7 +201,7 @@ func (h *HeadMonitor) getShellHeader(c context.Context, b *tz.BlockHash) (*core.
 	ctx, cancel := h.context(c)
 	defer cancel()
 	return block.ShellHeader(ctx, h.cfg.Client, &block.SimpleRequest{
-		Chain: h.cfg.ChainID.String(),
+		Chain: h.cfg.Chain.String(),
 		Block: b.String(),
 	})
 }
@@ -104,7 +209,29 @@ func (h *HeadMonitor) getShellHeader(c context.Context, b *tz.BlockHash) (*core.
 func (h *HeadMonitor) getBlockInfo(c context.Context, b string) (*block.BasicBlockInfo, error) {
 	ctx, cancel := h.context(c)
 	defer cancel()
-	return block.BasicInfo(ctx, h.cfg.Client, h.cfg.ChainID.String(), b)
+	return block.BasicInfo(ctx, h.cfg.Client, h.cfg.Chain.String(), b)
+}
+
+// inherit copies the last observed status of the replaced monitor
+func (h *HeadMonitor) inherit(old *HeadMonitor) {
+	s := old.HeadStatus()
+	old.mtx.RLock()
+	chain, lastReorg, deepReorg := old.chain, old.lastReorg, old.deepReorg
+	proto, next := old.protocol, old.nextProtocol
+	old.mtx.RUnlock()
+	h.mtx.Lock()
+	h.status = s
+	h.chain, h.lastReorg, h.deepReorg = chain, lastReorg, deepReorg
+	h.protocol, h.nextProtocol = proto, next
+	h.mtx.Unlock()
+	v := 0.0
+	if s.OK {
+		v = 1
+	}
+	h.metric.Set(v)
+	if !s.Updated.IsZero() {
+		h.levelGauge.Set(float64(s.Level))
+	}
 }
 
 func (h *HeadMonitor) Start() {
@@ -124,22 +251,47 @@ func (h *HeadMonitor) Stop(ctx context.Context) error {
 	}
 }
 
+// stallTimeout returns the watchdog timeout or 0 if it's disabled
+func (h *HeadMonitor) stallTimeout(minBlockDelay time.Duration) time.Duration {
+	return time.Duration(h.cfg.StallFactor * float64(minBlockDelay))
+}
+
+// resetTimer stops the timer, drains its channel if necessary and restarts it
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
 func (h *HeadMonitor) serve(ctx context.Context) {
 	defer close(h.done)
-	var err error
-	for {
-		h.mtx.Lock()
-		h.status = false
-		h.mtx.Unlock()
-		h.metric.Set(0)
+	var (
+		err error
+		// attempt is the number of consecutive failed connections
+		attempt int
+	)
+	for first := true; ; first = false {
+		// keep the inherited status until the connection is lost
+		if !first {
+			h.mtx.Lock()
+			h.status.OK = false
+			h.status.Late = false
+			if err != nil {
+				h.status.Error = err.Error()
+			}
+			h.mtx.Unlock()
+			h.metric.Set(0)
+		}
 		if err != nil {
-			log.Error(err)
-			t := time.After(h.cfg.ReconnectDelay)
-			select {
-			case <-t:
-			case <-ctx.Done():
+			h.cfg.Logger.Error(err)
+			if !h.cfg.Reconnect.Wait(ctx, attempt) {
 				return
 			}
+			attempt++
 		}
 
 		var bi *block.BasicBlockInfo
@@ -162,12 +314,24 @@ func (h *HeadMonitor) serve(ctx context.Context) {
 			}
 			continue
 		}
+		if err = h.trackHead(ctx, bi.Hash, sh); err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			continue
+		}
 		var timestamp time.Time
 		if h.cfg.UseTimestamps {
 			timestamp = sh.Timestamp.Time()
 		} else {
 			timestamp = time.Now()
 		}
+		// the arrival time of the current head is unknown so the first interval is measured by timestamps only
+		var (
+			prevLevel     = sh.Level
+			prevTimestamp = sh.Timestamp.Time()
+			prevArrival   time.Time
+		)
 
 		protoNum := sh.Proto
 		var minBlockDelay time.Duration
@@ -182,47 +346,87 @@ func (h *HeadMonitor) serve(ctx context.Context) {
 			stream <-chan *monitor.Head
 			errCh  <-chan error
 		)
-		stream, errCh, err = monitor.Heads(ctx, h.cfg.Client, &monitor.HeadsRequest{Chain: h.cfg.ChainID.String()})
+		// the stream is closed on reconnection, e.g. by the watchdog
+		streamCtx, stopStream := context.WithCancel(ctx)
+		stream, errCh, err = monitor.Heads(streamCtx, h.cfg.Client, &monitor.HeadsRequest{Chain: h.cfg.Chain.String()})
 		if err != nil {
+			stopStream()
 			if errors.Is(err, context.Canceled) {
 				return
 			}
 			continue
 		}
 
+		var stall <-chan time.Time
+		// progress is the time the level last increased
+		progress := time.Now()
+		stallTimer := time.NewTimer(h.stallTimeout(minBlockDelay))
+		if h.cfg.StallFactor > 0 {
+			stall = stallTimer.C
+		} else {
+			stallTimer.Stop()
+		}
+
 	Recv:
 		for {
 			select {
 			case err = <-errCh:
-				if errors.Is(err, context.Canceled) {
-					return
-				}
+				break Recv
+
+			case <-stall:
+				h.stallCounter.Inc()
+				err = fmt.Errorf("heads stream stalled: the level didn't increase for %v", h.stallTimeout(minBlockDelay))
 				break Recv
 
 			case head := <-stream:
+				if err = h.trackHead(ctx, head.Hash, &head.ShellHeader); err != nil {
+					break Recv
+				}
 				var t time.Time
 				if h.cfg.UseTimestamps {
 					t = head.Timestamp.Time()
 				} else {
 					t = time.Now()
 				}
-				status := t.Before(timestamp.Add(minBlockDelay + h.cfg.Tolerance))
-				log.Debugf("%v: %t", t, status)
+				maxDelay := minBlockDelay + h.cfg.Tolerance
+				status := t.Before(timestamp.Add(maxDelay))
+				late := !status && t.Before(timestamp.Add(maxDelay+h.cfg.DegradedTolerance))
+				h.cfg.Logger.Debugf("%v: %t", t, status)
 
 				var proto *core.BlockProtocols
 				proto, err = block.Protocols(ctx, h.cfg.Client, &block.SimpleRequest{
-					Chain: h.cfg.ChainID.String(),
+					Chain: h.cfg.Chain.String(),
 					Block: head.Hash.String(),
 				})
 				if err != nil {
-					if errors.Is(err, context.Canceled) {
-						return
-					}
 					break Recv
 				}
 
+				arrival := time.Now()
+				if stall != nil && head.Level > prevLevel {
+					progress = arrival
+					resetTimer(stallTimer, h.stallTimeout(minBlockDelay))
+				}
+				if head.Level == prevLevel+1 {
+					h.intervalHistogram.With(prometheus.Labels{"source": "timestamp"}).Observe(head.Timestamp.Time().Sub(prevTimestamp).Seconds())
+					if !prevArrival.IsZero() {
+						h.intervalHistogram.With(prometheus.Labels{"source": "arrival"}).Observe(arrival.Sub(prevArrival).Seconds())
+					}
+				}
+				prevLevel, prevTimestamp, prevArrival = head.Level, head.Timestamp.Time(), arrival
+				h.levelGauge.Set(float64(head.Level))
+
+				delay := t.Sub(timestamp)
 				h.mtx.Lock()
-				h.status = status
+				h.status = HeadStatus{
+					OK:       status,
+					Late:     late,
+					Level:    head.Level,
+					Hash:     head.Hash,
+					Delay:    delay,
+					MaxDelay: maxDelay,
+					Updated:  arrival,
+				}
 				h.protocol = proto.Protocol
 				h.nextProtocol = proto.NextProtocol
 				h.mtx.Unlock()
@@ -232,22 +436,79 @@ func (h *HeadMonitor) serve(ctx context.Context) {
 					v = 1
 				}
 				h.metric.Set(v)
+				h.publish(EventHead, &HeadEvent{
+					Level:     head.Level,
+					Hash:      head.Hash,
+					Timestamp: head.Timestamp.Time(),
+					Delay:     delay.String(),
+					Protocol:  proto.Protocol,
+				})
 				timestamp = t
+				attempt = 0
+				if h.cfg.Inclusion != nil {
+					h.cfg.Inclusion.NotifyHead(head.Hash, head.Level)
+				}
 				if head.Proto == protoNum {
 					break
 				}
 
 				// update constant
-				log.WithFields(log.Fields{"block": head.Hash, "proto": proto.Protocol}).Info("protocol upgrade")
+				h.cfg.Logger.WithFields(log.Fields{"block": head.Hash, "proto": proto.Protocol}).Info("protocol upgrade")
+				h.publish(EventProtocolUpgrade, &ProtocolUpgradeEvent{
+					Level:    head.Level,
+					Block:    head.Hash,
+					Protocol: proto.Protocol,
+				})
 				minBlockDelay, err = h.getMinBlockDelay(ctx, head.Hash.String(), proto.Protocol)
 				if err != nil {
-					if errors.Is(err, context.Canceled) {
-						return
-					}
 					break Recv
 				}
 				protoNum = head.Proto
+				if stall != nil {
+					// the watchdog's window depends on the new protocol's block delay
+					resetTimer(stallTimer, max(h.stallTimeout(minBlockDelay)-time.Since(progress), 0))
+				}
 			}
 		}
+		stopStream()
+		stallTimer.Stop()
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+	}
+}
+
+func (h *HeadMonitor) Name() string {
+	return "block_delay"
+}
+
+func (h *HeadMonitor) Metadata() *CheckMetadata {
+	return &CheckMetadata{
+		Description: "The last block arrived within minimal_block_delay + tolerance after its predecessor",
+	}
+}
+
+func (h *HeadMonitor) Evaluate() *CheckResult {
+	s := h.HeadStatus()
+	res := CheckResult{
+		Status:    checkStatus(s.OK),
+		Value:     s.Delay.String(),
+		Threshold: s.MaxDelay.String(),
+		Updated:   s.Updated,
+	}
+	switch {
+	case s.OK:
+	case s.Late:
+		res.Status = CheckWarn
+		res.Reason = fmt.Sprintf("block %s at level %d arrived %v after its predecessor", s.Hash, s.Level, s.Delay)
+	case s.Error != "":
+		res.Reason = fmt.Sprintf("head monitor is reconnecting: %s", s.Error)
+	case s.Updated.IsZero():
+		res.Reason = "no heads observed yet"
+	case s.Delay >= s.MaxDelay:
+		res.Reason = fmt.Sprintf("block %s at level %d arrived %v after its predecessor", s.Hash, s.Level, s.Delay)
+	default:
+		res.Reason = "no heads observed since reconnection"
 	}
+	return &res
 }
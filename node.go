@@ -0,0 +1,589 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/ecadlabs/gotez/v2"
+	client "github.com/ecadlabs/gotez/v2/clientv2"
+	"github.com/ecadlabs/gotez/v2/clientv2/utils"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	componentChain     = "chain_monitor"
+	componentInclusion = "inclusion_monitor"
+	componentHead      = "head_monitor"
+	componentPoller    = "poller"
+	componentMempool   = "mempool_monitor"
+	componentLag       = "lag_monitor"
+	componentProxy     = "proxy"
+	componentBreaker   = "circuit_breaker"
+)
+
+type service interface {
+	Start()
+	Stop(ctx context.Context) error
+}
+
+// Node is a set of monitors attached to a single Tezos node
+type Node struct {
+	name         string
+	events       EventSink
+	filterMetric *prometheus.CounterVec
+	logger       log.FieldLogger
+	router       *mux.Router
+	tracker      *HealthTracker
+	trackerReg   *prometheus.Registry
+
+	mtx     sync.RWMutex
+	st      *nodeState
+	running bool
+}
+
+// nodeState holds the node's configuration and monitors. It's never modified after being installed
+// and gets replaced as a whole on reload
+type nodeState struct {
+	cfg       *Config
+	nc        *NodeConfig
+	client    *client.Client
+	breaker   *CircuitBreaker
+	chain     *ChainMonitor
+	inclusion *InclusionMonitor
+	hmon      *HeadMonitor
+	poller    *Poller
+	mmon      *MempoolMonitor
+	lag       *LagMonitor
+	proxy     *Proxy
+	// every monitor has its own metrics registry to be replaced along with it
+	regs     map[string]*prometheus.Registry
+	checks   *CheckRegistry
+	livez    *Probe
+	readyz   *Probe
+	startupz *Probe
+}
+
+func (s *nodeState) services() []service {
+	out := []service{s.chain, s.inclusion, s.hmon, s.poller, s.mmon}
+	if s.lag != nil {
+		out = append(out, s.lag)
+	}
+	if s.proxy != nil {
+		out = append(out, s.proxy)
+	}
+	return out
+}
+
+func newClient(url string) *client.Client {
+	return &client.Client{
+		URL:         url,
+		DebugLogger: (*debugLogger)(log.StandardLogger()),
+	}
+}
+
+// The following methods return the monitors' configurations without the runtime fields.
+// They are compared on reload to find out which monitors must be restarted
+
+func (c *Config) chainMonitorConfig(cl *client.Client, nc *NodeConfig) *ChainMonitorConfig {
+	return &ChainMonitorConfig{
+		Client:   cl,
+		ChainID:  nc.ChainID,
+		Timeout:  c.Timeout,
+		Interval: c.PollInterval,
+	}
+}
+
+func (c *Config) headMonitorConfig(cl *client.Client, nc *NodeConfig) *HeadMonitorConfig {
+	return &HeadMonitorConfig{
+		Client:            cl,
+		Timeout:           c.Timeout,
+		Tolerance:         c.Tolerance,
+		DegradedTolerance: c.DegradedTolerance,
+		Reconnect:         c.ReconnectBackoff(),
+		UseTimestamps:     c.UseTimestamps,
+		ReorgWindow:       c.ReorgWindow,
+		MaxReorgDepth:     c.MaxReorgDepth,
+		ReorgHold:         c.ReorgHold,
+		StallFactor:       c.StallFactor,
+	}
+}
+
+func (c *Config) circuitBreakerConfig() *CircuitBreakerConfig {
+	return &CircuitBreakerConfig{
+		Threshold: c.BreakerThreshold,
+		Cooldown: Backoff{
+			Min:    c.BreakerCooldown,
+			Max:    c.ReconnectMaxDelay,
+			Jitter: c.ReconnectJitter,
+		},
+	}
+}
+
+func (c *Config) mempoolMonitorConfig(cl *client.Client, nc *NodeConfig) *MempoolMonitorConfig {
+	return &MempoolMonitorConfig{
+		Client:    cl,
+		Timeout:   c.Timeout,
+		Reconnect: c.ReconnectBackoff(),
+	}
+}
+
+func (c *Config) pollerConfig(cl *client.Client, nc *NodeConfig) *PollerConfig {
+	return &PollerConfig{
+		Client:           cl,
+		Timeout:          c.Timeout,
+		Interval:         c.PollInterval,
+		Reconnect:        c.ReconnectBackoff(),
+		MinConnections:   c.MinConnections,
+		MaxBranchDelayed: c.MaxBranchDelayed,
+		MaxRejections:    c.MempoolRejections,
+	}
+}
+
+func (c *Config) lagMonitorConfig(cl *client.Client, nc *NodeConfig) *LagMonitorConfig {
+	if len(c.References) == 0 {
+		return nil
+	}
+	refs := make([]*client.Client, len(c.References))
+	for i, u := range c.References {
+		refs[i] = newClient(u)
+	}
+	return &LagMonitorConfig{
+		Client:      cl,
+		References:  refs,
+		Timeout:     c.Timeout,
+		Interval:    c.PollInterval,
+		MaxLevelLag: c.MaxLevelLag,
+	}
+}
+
+func (c *Config) NewNode(ctx context.Context, nc *NodeConfig, events *EventBus, filterMetric *prometheus.CounterVec) (*Node, error) {
+	n := &Node{
+		name:         nc.Name,
+		events:       events.Node(nc.Name),
+		filterMetric: filterMetric,
+		logger:       log.WithField("node", nc.Name),
+		router:       mux.NewRouter(),
+		trackerReg:   prometheus.NewRegistry(),
+		st:           &nodeState{},
+	}
+	n.tracker = (&HealthTrackerConfig{
+		Reg:    n.wrapRegistry(n.trackerReg),
+		Logger: n.logger,
+		Events: n.events,
+	}).New()
+	n.RegisterRoutes(n.router)
+
+	u, err := n.Prepare(c, nc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", nc.Name, err)
+	}
+	if err := u.Apply(ctx); err != nil {
+		return nil, fmt.Errorf("%s: %w", nc.Name, err)
+	}
+	return n, nil
+}
+
+// wrapRegistry labels every metric produced by the node's monitors with the node name
+func (n *Node) wrapRegistry(reg *prometheus.Registry) prometheus.Registerer {
+	return prometheus.WrapRegistererWith(prometheus.Labels{"node": n.name}, reg)
+}
+
+func (n *Node) nextProtocol() *gotez.ProtocolHash {
+	_, p := n.state().hmon.Protocols()
+	return p
+}
+
+// protocolLabel returns the metric label of the protocol which may be not known yet
+func protocolLabel(p *gotez.ProtocolHash) string {
+	if p == nil {
+		return "unknown"
+	}
+	return p.String()
+}
+
+// NodeUpdate is a prepared change of the node's configuration
+type NodeUpdate struct {
+	node    *Node
+	old     *nodeState
+	st      *nodeState
+	stop    []service
+	start   []service
+	changed []string
+}
+
+func (u *NodeUpdate) replace(name string, old, s service, reg *prometheus.Registry) {
+	if old != nil {
+		u.stop = append(u.stop, old)
+	}
+	if s != nil {
+		u.start = append(u.start, s)
+		u.st.regs[name] = reg
+	} else {
+		delete(u.st.regs, name)
+	}
+	u.changed = append(u.changed, name)
+}
+
+// Changed returns the names of the monitors to be restarted
+func (u *NodeUpdate) Changed() []string {
+	return u.changed
+}
+
+// Prepare creates the monitors affected by the configuration change without starting them.
+// The running monitors are left intact until the update is applied
+func (n *Node) Prepare(conf *Config, nc *NodeConfig) (*NodeUpdate, error) {
+	old := n.state()
+	st := *old
+	st.cfg, st.nc = conf, nc
+	st.regs = maps.Clone(old.regs)
+	if st.regs == nil {
+		st.regs = make(map[string]*prometheus.Registry)
+	}
+	if bc := conf.circuitBreakerConfig(); old.client == nil || old.nc.URL != nc.URL || !reflect.DeepEqual(old.cfg.circuitBreakerConfig(), bc) {
+		// the monitors using the old client get restarted as their configurations differ
+		reg := prometheus.NewRegistry()
+		bc.Reg, bc.Logger = n.wrapRegistry(reg), n.logger
+		st.breaker = bc.New()
+		st.client = newClient(nc.URL)
+		st.client.Client = &http.Client{Transport: st.breaker}
+		st.regs[componentBreaker] = reg
+	}
+	u := &NodeUpdate{node: n, old: old, st: &st}
+
+	// the monitors depend on the chain monitor so they are restarted along with it
+	var chainReplaced bool
+	if cc := conf.chainMonitorConfig(st.client, nc); old.chain == nil || !reflect.DeepEqual(old.cfg.chainMonitorConfig(old.client, old.nc), cc) {
+		reg := prometheus.NewRegistry()
+		cc.Reg, cc.Logger, cc.Events = n.wrapRegistry(reg), n.logger, n.events
+		st.chain = cc.New()
+		var prev service
+		if old.chain != nil {
+			prev = old.chain
+		}
+		u.replace(componentChain, prev, st.chain, reg)
+		chainReplaced = true
+	}
+
+	// the monitors and the poller feeding the inclusion monitor depend on the chain and the timeout too
+	if chainReplaced || old.cfg.Timeout != conf.Timeout {
+		reg := prometheus.NewRegistry()
+		st.inclusion = (&InclusionMonitorConfig{
+			Client:  st.client,
+			Chain:   st.chain,
+			Timeout: conf.Timeout,
+			Reg:     n.wrapRegistry(reg),
+			Logger:  n.logger,
+		}).New()
+		var prev service
+		if old.inclusion != nil {
+			prev = old.inclusion
+		}
+		u.replace(componentInclusion, prev, st.inclusion, reg)
+	}
+
+	if hc := conf.headMonitorConfig(st.client, nc); chainReplaced || old.hmon == nil || !reflect.DeepEqual(old.cfg.headMonitorConfig(old.client, old.nc), hc) {
+		reg := prometheus.NewRegistry()
+		hc.Chain, hc.Inclusion, hc.Reg, hc.Logger, hc.Events = st.chain, st.inclusion, n.wrapRegistry(reg), n.logger, n.events
+		st.hmon = hc.New()
+		var prev service
+		if old.hmon != nil {
+			prev = old.hmon
+		}
+		u.replace(componentHead, prev, st.hmon, reg)
+	}
+
+	if mc := conf.mempoolMonitorConfig(st.client, nc); chainReplaced || old.mmon == nil || !reflect.DeepEqual(old.cfg.mempoolMonitorConfig(old.client, old.nc), mc) {
+		reg := prometheus.NewRegistry()
+		mc.Chain, mc.Inclusion, mc.Reg, mc.Logger, mc.NextProtocolFunc = st.chain, st.inclusion, n.wrapRegistry(reg), n.logger, n.nextProtocol
+		st.mmon = mc.New()
+		var prev service
+		if old.mmon != nil {
+			prev = old.mmon
+		}
+		u.replace(componentMempool, prev, st.mmon, reg)
+	}
+
+	if pc := conf.pollerConfig(st.client, nc); chainReplaced || old.poller == nil || !reflect.DeepEqual(old.cfg.pollerConfig(old.client, old.nc), pc) {
+		reg := prometheus.NewRegistry()
+		pc.Chain, pc.Inclusion, pc.Reg, pc.Logger, pc.Events, pc.NextProtocolFunc = st.chain, st.inclusion, n.wrapRegistry(reg), n.logger, n.events, n.nextProtocol
+		st.poller = pc.New()
+		var prev service
+		if old.poller != nil {
+			prev = old.poller
+		}
+		u.replace(componentPoller, prev, st.poller, reg)
+	}
+
+	lc := conf.lagMonitorConfig(st.client, nc)
+	switch {
+	case lc == nil && old.lag != nil:
+		st.lag = nil
+		u.replace(componentLag, old.lag, nil, nil)
+	case lc != nil && (chainReplaced || old.lag == nil || !reflect.DeepEqual(old.cfg.lagMonitorConfig(old.client, old.nc), lc)):
+		reg := prometheus.NewRegistry()
+		lc.Chain, lc.Reg, lc.Logger = st.chain, n.wrapRegistry(reg), n.logger
+		st.lag = lc.New()
+		var prev service
+		if old.lag != nil {
+			prev = old.lag
+		}
+		u.replace(componentLag, prev, st.lag, reg)
+	}
+
+	switch {
+	case nc.ProxyListen == "" && old.proxy != nil:
+		st.proxy = nil
+		u.replace(componentProxy, old.proxy, nil, nil)
+	case nc.ProxyListen != "" && (old.proxy == nil || old.nc.URL != nc.URL || old.nc.ProxyListen != nc.ProxyListen || !reflect.DeepEqual(old.nc.ProxyFilter, nc.ProxyFilter)):
+		var (
+			filter *PathFilter
+			err    error
+		)
+		if nc.ProxyFilter != nil {
+			if filter, err = nc.ProxyFilter.New(nc.ProxyListen, n.filterMetric); err != nil {
+				return nil, err
+			}
+		}
+		reg := prometheus.NewRegistry()
+		st.proxy, err = (&ProxyConfig{
+			Listen:     nc.ProxyListen,
+			URL:        nc.URL,
+			HealthFunc: func() bool { s, _ := n.tracker.State(); return s != HealthUnhealthy },
+			Filter:     filter,
+			Reg:        n.wrapRegistry(reg),
+			Logger:     n.logger,
+		}).New()
+		if err != nil {
+			return nil, err
+		}
+		var prev service
+		if old.proxy != nil {
+			prev = old.proxy
+		}
+		u.replace(componentProxy, prev, st.proxy, reg)
+	}
+
+	// the checks are cheap to rebuild so do it unconditionally
+	st.checks = NewCheckRegistry()
+	st.checks.Register(st.poller.RPCChecker())
+	st.checks.Register(st.poller)
+	st.checks.Register(st.hmon)
+	st.checks.Register(st.hmon.ReorgChecker())
+	st.checks.Register(st.poller.ConnectionsChecker())
+	st.checks.Register(st.poller.BranchDelayedChecker())
+	st.checks.Register(st.chain)
+	st.checks.Register(st.breaker)
+	if st.lag != nil {
+		st.checks.Register(st.lag)
+	}
+	if err := st.checks.Configure(conf.HealthChecks()); err != nil {
+		return nil, err
+	}
+
+	var err error
+	probes := conf.ProbeChecks()
+	if st.livez, err = st.checks.NewProbe(probes.Livez, false); err != nil {
+		return nil, fmt.Errorf("livez: %w", err)
+	}
+	if st.readyz, err = st.checks.NewProbe(probes.Readyz, false); err != nil {
+		return nil, fmt.Errorf("readyz: %w", err)
+	}
+	if st.startupz, err = st.checks.NewProbe(probes.Startupz, true); err != nil {
+		return nil, fmt.Errorf("startupz: %w", err)
+	}
+	if old.startupz != nil {
+		st.startupz.inherit(old.startupz)
+	}
+	return u, nil
+}
+
+// Apply stops the replaced monitors and installs the new ones. The new monitors are started if the node is running
+func (u *NodeUpdate) Apply(ctx context.Context) error {
+	n := u.node
+	var errs []error
+	// stop first to release the proxy's listening socket
+	for _, s := range u.stop {
+		errs = append(errs, s.Stop(ctx))
+	}
+	// carry over the last observed state to avoid false negatives until the first update
+	if u.old.chain != nil && u.st.chain != u.old.chain && u.old.nc.URL == u.st.nc.URL {
+		u.st.chain.inherit(u.old.chain)
+	}
+	if u.old.hmon != nil && u.st.hmon != u.old.hmon {
+		u.st.hmon.inherit(u.old.hmon)
+	}
+	if u.old.inclusion != nil && u.st.inclusion != u.old.inclusion {
+		u.st.inclusion.inherit(u.old.inclusion)
+	}
+	if u.old.mmon != nil && u.st.mmon != u.old.mmon {
+		u.st.mmon.inherit(u.old.mmon)
+	}
+	if u.old.poller != nil && u.st.poller != u.old.poller {
+		u.st.poller.inherit(u.old.poller)
+	}
+	if u.old.lag != nil && u.st.lag != nil && u.st.lag != u.old.lag {
+		u.st.lag.inherit(u.old.lag)
+	}
+
+	n.mtx.Lock()
+	n.st = u.st
+	running := n.running
+	n.mtx.Unlock()
+
+	n.tracker.Configure(&HealthTrackerConfig{
+		Checks:   u.st.checks,
+		Interval: u.st.cfg.HealthInterval,
+		Rise:     u.st.cfg.HealthRise,
+		Fall:     u.st.cfg.HealthFall,
+		MinHold:  u.st.cfg.HealthMinHold,
+	})
+
+	if running {
+		for _, s := range u.start {
+			s.Start()
+		}
+		if len(u.changed) != 0 {
+			n.logger.WithField("monitors", u.changed).Info("monitors restarted")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (n *Node) Name() string {
+	return n.name
+}
+
+func (n *Node) state() *nodeState {
+	n.mtx.RLock()
+	defer n.mtx.RUnlock()
+	return n.st
+}
+
+// Gatherers returns the node's metrics registries
+func (n *Node) Gatherers() prometheus.Gatherers {
+	st := n.state()
+	out := prometheus.Gatherers{n.trackerReg}
+	for _, reg := range st.regs {
+		out = append(out, reg)
+	}
+	return out
+}
+
+func (n *Node) Start() {
+	n.mtx.Lock()
+	n.running = true
+	st := n.st
+	n.mtx.Unlock()
+	for _, s := range st.services() {
+		s.Start()
+	}
+	n.tracker.Start()
+}
+
+func (n *Node) Stop(ctx context.Context) error {
+	n.mtx.Lock()
+	n.running = false
+	st := n.st
+	n.mtx.Unlock()
+	errs := []error{n.tracker.Stop(ctx)}
+	svcs := st.services()
+	for i := len(svcs) - 1; i >= 0; i-- {
+		errs = append(errs, svcs[i].Stop(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func statusCode(ok bool) int {
+	if ok {
+		return http.StatusOK
+	}
+	return http.StatusInternalServerError
+}
+
+func (n *Node) SyncStatus(w http.ResponseWriter, r *http.Request) {
+	status := n.state().poller.Status()
+	writeJSON(w, statusCode(status.Bootstrapped && status.SyncState == utils.SyncStateSynced), status)
+}
+
+func (n *Node) BlockDelay(w http.ResponseWriter, r *http.Request) {
+	status := n.state().hmon.Status()
+	writeJSON(w, statusCode(status), status)
+}
+
+func (n *Node) HeadLag(w http.ResponseWriter, r *http.Request) {
+	lag := n.state().lag
+	if lag == nil {
+		http.Error(w, "no reference nodes configured", http.StatusNotFound)
+		return
+	}
+	status, ok := lag.Status()
+	writeJSON(w, statusCode(ok), &status)
+}
+
+func (n *Node) MempoolFees(w http.ResponseWriter, r *http.Request) {
+	fees := n.state().poller.MempoolFees()
+	if fees == nil {
+		http.Error(w, "mempool was not polled yet", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, fees)
+}
+
+func (n *Node) MempoolRejections(w http.ResponseWriter, r *http.Request) {
+	p := n.state().poller
+	if p.cfg.MaxRejections <= 0 {
+		http.Error(w, "mempool_rejections is not set", http.StatusNotFound)
+		return
+	}
+	rej := p.MempoolRejections()
+	if rej == nil {
+		http.Error(w, "mempool was not polled yet", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, rej)
+}
+
+func (n *Node) Livez(w http.ResponseWriter, r *http.Request) {
+	n.state().livez.ServeHTTP(w, r)
+}
+
+func (n *Node) Readyz(w http.ResponseWriter, r *http.Request) {
+	n.state().readyz.ServeHTTP(w, r)
+}
+
+func (n *Node) Startupz(w http.ResponseWriter, r *http.Request) {
+	n.state().startupz.ServeHTTP(w, r)
+}
+
+// RegisterRoutes adds the node's endpoints to the router
+func (n *Node) RegisterRoutes(r *mux.Router) {
+	r.Methods("GET").Path("/health").HandlerFunc(n.Health)
+	r.Methods("GET").Path("/health/details").HandlerFunc(n.HealthDetails)
+	r.Methods("GET").Path("/health/checks").HandlerFunc(n.HealthChecks)
+	r.Methods("GET").Path("/sync_status").HandlerFunc(n.SyncStatus)
+	r.Methods("GET").Path("/block_delay").HandlerFunc(n.BlockDelay)
+	r.Methods("GET").Path("/head_lag").HandlerFunc(n.HeadLag)
+	r.Methods("GET").Path("/mempool/fees").HandlerFunc(n.MempoolFees)
+	r.Methods("GET").Path("/mempool/rejections").HandlerFunc(n.MempoolRejections)
+	r.Methods("GET").Path("/livez").HandlerFunc(n.Livez)
+	r.Methods("GET").Path("/readyz").HandlerFunc(n.Readyz)
+	r.Methods("GET").Path("/startupz").HandlerFunc(n.Startupz)
+}
+
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.router.ServeHTTP(w, r)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const envPrefix = "OCTEZ_SC_"
+
+// ConfigSource builds the effective configuration. The precedence is flags > environment > file > defaults
+type ConfigSource struct {
+	// Path is the optional config file path
+	Path string
+	// Env looks up the environment variables, os.LookupEnv is used if nil
+	Env func(string) (string, bool)
+	// Flags holds the values of the command line overrides keyed by the field names
+	Flags map[string]string
+	// Strict makes unknown fields an error
+	Strict bool
+}
+
+type configField struct {
+	name  string
+	value reflect.Value
+}
+
+// configFields returns the top level fields of the config along with their YAML names
+func configFields(c *Config) []configField {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	out := make([]configField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		out = append(out, configField{name: name, value: v.Field(i)})
+	}
+	return out
+}
+
+func envName(field string) string {
+	return envPrefix + strings.ToUpper(field)
+}
+
+func flagName(field string) string {
+	return strings.ReplaceAll(field, "_", "-")
+}
+
+// set parses the value as YAML. Strings are taken verbatim and complex fields accept the YAML flow syntax
+func (f *configField) set(value string, strict bool) error {
+	if f.value.Kind() == reflect.String {
+		f.value.SetString(value)
+		return nil
+	}
+	v := reflect.New(f.value.Type())
+	if err := decodeYAML([]byte(value), v.Interface(), strict); err != nil {
+		return err
+	}
+	f.value.Set(v.Elem())
+	return nil
+}
+
+type overrideFlag struct {
+	src    *ConfigSource
+	name   string
+	isBool bool
+}
+
+func (f *overrideFlag) String() string {
+	return ""
+}
+
+func (f *overrideFlag) Set(v string) error {
+	f.src.Flags[f.name] = v
+	return nil
+}
+
+func (f *overrideFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// RegisterFlags adds a flag for every config field. The values are collected into s.Flags
+func (s *ConfigSource) RegisterFlags(fs *flag.FlagSet) {
+	if s.Flags == nil {
+		s.Flags = make(map[string]string)
+	}
+	for _, f := range configFields(DefaultConfig()) {
+		fs.Var(&overrideFlag{
+			src:    s,
+			name:   f.name,
+			isBool: f.value.Kind() == reflect.Bool,
+		}, flagName(f.name), fmt.Sprintf("Overrides the %s config field (env %s)", f.name, envName(f.name)))
+	}
+}
+
+// Load returns the effective configuration
+func (s *ConfigSource) Load() (*Config, error) {
+	conf := DefaultConfig()
+	if s.Path != "" {
+		var err error
+		if conf, err = LoadConfig(s.Path, s.Strict); err != nil {
+			return nil, err
+		}
+	}
+	lookup := s.Env
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+	for _, f := range configFields(conf) {
+		if v, ok := lookup(envName(f.name)); ok {
+			if err := f.set(v, s.Strict); err != nil {
+				return nil, fmt.Errorf("%s: %w", envName(f.name), err)
+			}
+		}
+		if v, ok := s.Flags[f.name]; ok {
+			if err := f.set(v, s.Strict); err != nil {
+				return nil, fmt.Errorf("-%s: %w", flagName(f.name), err)
+			}
+		}
+	}
+	return conf, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"sync"
 	"time"
 
@@ -19,19 +20,37 @@ import (
 )
 
 type PollerConfig struct {
-	Client           *client.Client
-	ChainID          *tz.ChainID
-	Timeout          time.Duration
-	Interval         time.Duration
+	Client   *client.Client
+	Chain    *ChainMonitor
+	Timeout  time.Duration
+	Interval time.Duration
+	// Reconnect is the polling policy used while all requests fail. The interval is never shorter than Interval
+	Reconnect        Backoff
+	MinConnections   int
+	MaxBranchDelayed int
+	// MaxRejections is the number of rejected operations kept for MempoolRejections. 0 disables the list
+	MaxRejections    int
 	Reg              prometheus.Registerer
 	NextProtocolFunc func() *tz.ProtocolHash
+	// Inclusion forgets the refused and outdated operations if not nil
+	Inclusion *InclusionMonitor
+	Logger    log.FieldLogger
+	Events    EventSink
 }
 
 type Poller struct {
 	cfg PollerConfig
 
-	mtx    sync.RWMutex
-	status utils.BootstrappedResponse
+	mtx     sync.RWMutex
+	status  utils.BootstrappedResponse
+	updated time.Time
+	err     error
+
+	connections        int
+	connectionsUpdated time.Time
+	branchDelayed      int
+	mempoolUpdated     time.Time
+	rejected           []*RejectedOperation
 
 	cancel context.CancelFunc
 	done   chan struct{}
@@ -39,6 +58,8 @@ type Poller struct {
 	bsGauge   prometheus.Gauge
 	connGauge *prometheus.GaugeVec
 	opsGauge  *prometheus.GaugeVec
+	rejGauge  *prometheus.GaugeVec
+	fees      *feeCollector
 }
 
 func (c *PollerConfig) New() *Poller {
@@ -62,15 +83,36 @@ func (c *PollerConfig) New() *Poller {
 			Name:      "mempool_operations",
 			Help:      "The current number of mempool operations.",
 		}, []string{"kind", "pool", "proto"}),
+		rejGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "mempool_rejections",
+			Help:      "The current number of rejected mempool operations by the outermost error of the trace.",
+		}, []string{"pool", "error_id"}),
+		fees: newFeeCollector(),
 	}
 	if c.Reg != nil {
 		c.Reg.MustRegister(b.bsGauge)
 		c.Reg.MustRegister(b.connGauge)
 		c.Reg.MustRegister(b.opsGauge)
+		c.Reg.MustRegister(b.rejGauge)
+		c.Reg.MustRegister(b.fees)
 	}
 	return b
 }
 
+// inherit copies the last observed state of the replaced poller
+func (p *Poller) inherit(old *Poller) {
+	old.mtx.RLock()
+	defer old.mtx.RUnlock()
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.status, p.updated, p.err = old.status, old.updated, old.err
+	p.connections, p.connectionsUpdated = old.connections, old.connectionsUpdated
+	p.branchDelayed, p.mempoolUpdated, p.rejected = old.branchDelayed, old.mempoolUpdated, old.rejected
+	p.fees.update(old.fees.get())
+}
+
 func (p *Poller) Start() {
 	ctx, cancel := context.WithCancel(context.Background())
 	p.cancel = cancel
@@ -94,8 +136,15 @@ func (p *Poller) Status() utils.BootstrappedResponse {
 	return p.status
 }
 
+// LastUpdate returns the time of the last successful bootstrap state poll and the last poll error, if any
+func (p *Poller) LastUpdate() (time.Time, error) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.updated, p.err
+}
+
 func (p *Poller) loop(ctx context.Context) {
-	t := time.NewTicker(p.cfg.Interval)
+	t := time.NewTimer(p.cfg.Interval)
 	defer func() {
 		t.Stop()
 		close(p.done)
@@ -108,25 +157,44 @@ func (p *Poller) loop(ctx context.Context) {
 	}
 	errCh := make(chan error, len(pollers))
 
+	// attempt is the number of consecutive rounds in which all requests failed
+	var attempt int
 	for {
 		for _, poller := range pollers {
 			go poller(ctx, errCh)
 		}
-		done := false
+		var (
+			done   bool
+			failed int
+		)
 		for range pollers {
 			err := <-errCh
-			if err != nil {
-				if errors.Is(err, context.Canceled) {
-					done = true
-				} else {
-					log.WithField("chain_id", p.cfg.ChainID).Warn(err)
-				}
+			switch {
+			case err == nil:
+			case errors.Is(err, context.Canceled):
+				done = true
+			case errors.Is(err, ErrCircuitOpen):
+				failed++
+				p.cfg.Logger.Debug(err)
+			default:
+				failed++
+				p.cfg.Logger.WithField("chain_id", p.cfg.Chain).Warn(err)
 			}
 		}
 		if done {
 			return
 		}
 
+		wait := p.cfg.Interval
+		if failed == len(pollers) {
+			// the node is likely down
+			wait = max(wait, p.cfg.Reconnect.Delay(attempt))
+			attempt++
+		} else {
+			attempt = 0
+		}
+		// the timer may have fired during a long round
+		resetTimer(t, wait)
 		select {
 		case <-t.C:
 		case <-ctx.Done():
@@ -141,13 +209,36 @@ func (p *Poller) pollBootstrapped(ctx context.Context, errCh chan<- error) {
 
 	c, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
 	defer cancel()
-	resp, err := utils.IsBootstrapped(c, p.cfg.Client, p.cfg.ChainID)
+	chainID, err := p.cfg.Chain.Resolve(c)
+	var resp *utils.BootstrappedResponse
+	if err == nil {
+		resp, err = utils.IsBootstrapped(c, p.cfg.Client, chainID)
+	}
 	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			p.mtx.Lock()
+			p.err = err
+			p.mtx.Unlock()
+		}
 		return
 	}
 	p.mtx.Lock()
+	prev, known := p.status, !p.updated.IsZero()
 	p.status = *resp
+	p.updated = time.Now()
+	p.err = nil
 	p.mtx.Unlock()
+	if known && prev != *resp {
+		p.cfg.Logger.WithFields(log.Fields{"bootstrapped": resp.Bootstrapped, "sync_state": resp.SyncState}).Info("sync state changed")
+		if p.cfg.Events != nil {
+			p.cfg.Events.Publish(EventSyncState, &SyncStateEvent{
+				Bootstrapped:     resp.Bootstrapped,
+				SyncState:        resp.SyncState.String(),
+				PrevBootstrapped: prev.Bootstrapped,
+				PrevSyncState:    prev.SyncState.String(),
+			})
+		}
+	}
 	v := 0.0
 	if resp.SyncState == utils.SyncStateSynced && resp.Bootstrapped {
 		v = 1
@@ -166,6 +257,11 @@ func (p *Poller) pollConnections(ctx context.Context, errCh chan<- error) {
 		return
 	}
 
+	p.mtx.Lock()
+	p.connections = len(resp.Connections)
+	p.connectionsUpdated = time.Now()
+	p.mtx.Unlock()
+
 	p.connGauge.Reset()
 	for _, conn := range resp.Connections {
 		var dir string
@@ -192,17 +288,18 @@ func (p *Poller) pollMempoolOperations(ctx context.Context, errCh chan<- error)
 
 	c, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
 	defer cancel()
-	resp, err := mempool.PendingOperations(c, p.cfg.Client, p.cfg.ChainID)
+	chainID, err := p.cfg.Chain.Resolve(c)
+	if err != nil {
+		return
+	}
+	resp, err := mempool.PendingOperations(c, p.cfg.Client, chainID)
 	if err != nil {
 		return
 	}
 
-	p.opsGauge.Reset()
-	gauge := p.opsGauge.MustCurryWith(prometheus.Labels{"proto": p.cfg.NextProtocolFunc().String()})
-
-	g := gauge.MustCurryWith(prometheus.Labels{"pool": "validated"})
-	for _, list := range resp.Validated {
-		updatePool(g, list.Contents)
+	var branchDelayed int
+	for _, list := range resp.BranchDelayed {
+		branchDelayed += len(list.Contents)
 	}
 
 	pools := [][]*mempool.PendingOperationsListWithError{
@@ -212,6 +309,51 @@ func (p *Poller) pollMempoolOperations(ctx context.Context, errCh chan<- error)
 		resp.BranchDelayed,
 	}
 	poolNames := []string{"refused", "outdated", "branch_refused", "branch_delayed"}
+
+	p.rejGauge.Reset()
+	// the list is ordered by pool and hash, so the same operations are kept while the mempool doesn't change
+	var rejected []*RejectedOperation
+	for i, pool := range pools {
+		ops := make([]*RejectedOperation, 0, len(pool))
+		for _, list := range pool {
+			op := newRejectedOperation(poolNames[i], list)
+			p.rejGauge.With(prometheus.Labels{"pool": op.Pool, "error_id": op.ErrorIDs[0]}).Inc()
+			ops = append(ops, op)
+		}
+		if p.cfg.MaxRejections > 0 {
+			slices.SortFunc(ops, compareRejected)
+			rejected = append(rejected, ops...)
+		}
+	}
+	if len(rejected) > p.cfg.MaxRejections {
+		rejected = rejected[:p.cfg.MaxRejections]
+	}
+	if p.cfg.Inclusion != nil {
+		var dropped []*tz.OperationHash
+		for _, pool := range [][]*mempool.PendingOperationsListWithError{resp.Refused, resp.Outdated} {
+			for _, list := range pool {
+				if list.Hash != nil {
+					dropped = append(dropped, list.Hash)
+				}
+			}
+		}
+		p.cfg.Inclusion.Drop(dropped)
+	}
+
+	p.mtx.Lock()
+	p.branchDelayed = branchDelayed
+	p.mempoolUpdated = time.Now()
+	p.rejected = rejected
+	p.mtx.Unlock()
+
+	p.opsGauge.Reset()
+	gauge := p.opsGauge.MustCurryWith(prometheus.Labels{"proto": protocolLabel(p.cfg.NextProtocolFunc())})
+
+	g := gauge.MustCurryWith(prometheus.Labels{"pool": "validated"})
+	for _, list := range resp.Validated {
+		updatePool(g, list.Contents)
+	}
+
 	for i, pool := range pools {
 		g := gauge.MustCurryWith(prometheus.Labels{"pool": poolNames[i]})
 		for _, list := range pool {
@@ -223,4 +365,171 @@ func (p *Poller) pollMempoolOperations(ctx context.Context, errCh chan<- error)
 	for _, list := range resp.Unprocessed {
 		updatePool(g, list.Contents)
 	}
+
+	p.fees.update(newFeeSnapshot(resp))
+}
+
+// MempoolRejections returns the rejected operations of the last polled mempool. It returns nil
+// if the list is disabled or the mempool wasn't polled yet
+func (p *Poller) MempoolRejections() *MempoolRejections {
+	if p.cfg.MaxRejections <= 0 {
+		return nil
+	}
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	if p.mempoolUpdated.IsZero() {
+		return nil
+	}
+	return &MempoolRejections{
+		Updated:    p.mempoolUpdated,
+		Operations: p.rejected,
+	}
+}
+
+// MempoolFees returns the distribution of fees in the last polled mempool or nil if it wasn't polled yet
+func (p *Poller) MempoolFees() *MempoolFees {
+	s := p.fees.get()
+	if s == nil {
+		return nil
+	}
+	return s.report()
+}
+
+func (p *Poller) Name() string {
+	return "bootstrapped"
+}
+
+func (p *Poller) Metadata() *CheckMetadata {
+	return &CheckMetadata{
+		Description: "The node is bootstrapped and its chain is synchronized",
+	}
+}
+
+type bootstrappedValue struct {
+	Bootstrapped bool   `json:"bootstrapped"`
+	SyncState    string `json:"sync_state"`
+}
+
+func (p *Poller) Evaluate() *CheckResult {
+	s := p.Status()
+	updated, err := p.LastUpdate()
+	res := CheckResult{
+		Status: checkStatus(!updated.IsZero() && s.Bootstrapped && s.SyncState == utils.SyncStateSynced),
+		Value: &bootstrappedValue{
+			Bootstrapped: s.Bootstrapped,
+			SyncState:    s.SyncState.String(),
+		},
+		Threshold: &bootstrappedValue{
+			Bootstrapped: true,
+			SyncState:    utils.SyncStateSynced.String(),
+		},
+		Updated: updated,
+	}
+	switch {
+	case err != nil:
+		res.Reason = err.Error()
+	case updated.IsZero():
+		res.Reason = "bootstrap state is not known yet"
+	case !s.Bootstrapped:
+		res.Reason = "the node is bootstrapping"
+	case s.SyncState != utils.SyncStateSynced:
+		res.Reason = fmt.Sprintf("the node is %s", s.SyncState)
+	}
+	return &res
+}
+
+// RPCChecker returns a check of the node's RPC availability
+func (p *Poller) RPCChecker() Checker {
+	return (*rpcChecker)(p)
+}
+
+type rpcChecker Poller
+
+func (c *rpcChecker) Name() string {
+	return "rpc"
+}
+
+func (c *rpcChecker) Metadata() *CheckMetadata {
+	return &CheckMetadata{
+		Description: "The node's RPC server responded to the last request",
+	}
+}
+
+func (c *rpcChecker) Evaluate() *CheckResult {
+	updated, err := (*Poller)(c).LastUpdate()
+	res := CheckResult{
+		Status:  checkStatus(err == nil),
+		Value:   err == nil,
+		Updated: updated,
+	}
+	if err != nil {
+		res.Reason = err.Error()
+	}
+	return &res
+}
+
+// ConnectionsChecker returns a check of the number of peer connections
+func (p *Poller) ConnectionsChecker() Checker {
+	return (*connectionsChecker)(p)
+}
+
+type connectionsChecker Poller
+
+func (c *connectionsChecker) Name() string {
+	return "connections"
+}
+
+func (c *connectionsChecker) Metadata() *CheckMetadata {
+	return &CheckMetadata{
+		Description: "The number of peer connections is not below min_connections",
+	}
+}
+
+func (c *connectionsChecker) Evaluate() *CheckResult {
+	c.mtx.RLock()
+	conns, updated := c.connections, c.connectionsUpdated
+	c.mtx.RUnlock()
+	res := CheckResult{
+		Status:    checkStatus(conns >= c.cfg.MinConnections),
+		Value:     conns,
+		Threshold: c.cfg.MinConnections,
+		Updated:   updated,
+	}
+	if res.Status != CheckPass {
+		res.Reason = fmt.Sprintf("the node has %d connections", conns)
+	}
+	return &res
+}
+
+// BranchDelayedChecker returns a check of the number of operations in the branch_delayed mempool
+func (p *Poller) BranchDelayedChecker() Checker {
+	return (*branchDelayedChecker)(p)
+}
+
+type branchDelayedChecker Poller
+
+func (c *branchDelayedChecker) Name() string {
+	return "branch_delayed"
+}
+
+func (c *branchDelayedChecker) Metadata() *CheckMetadata {
+	return &CheckMetadata{
+		Description: "The number of branch_delayed mempool operations does not exceed max_branch_delayed",
+	}
+}
+
+func (c *branchDelayedChecker) Evaluate() *CheckResult {
+	c.mtx.RLock()
+	ops, updated := c.branchDelayed, c.mempoolUpdated
+	c.mtx.RUnlock()
+	res := CheckResult{
+		Status:    checkStatus(c.cfg.MaxBranchDelayed == 0 || ops <= c.cfg.MaxBranchDelayed),
+		Value:     ops,
+		Threshold: c.cfg.MaxBranchDelayed,
+		Updated:   updated,
+	}
+	if res.Status != CheckPass {
+		res.Reason = fmt.Sprintf("%d operations are branch delayed", ops)
+	}
+	return &res
 }
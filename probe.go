@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Probe is a Kubernetes style probe which passes if none of its checks fail
+type Probe struct {
+	checks []Checker
+	// latch makes the probe pass forever once it passed for the first time
+	latch bool
+
+	mtx    sync.Mutex
+	passed bool
+}
+
+// ProbeReport is the verbose form of the probe output
+type ProbeReport struct {
+	OK     bool           `json:"ok"`
+	Checks []*CheckResult `json:"checks"`
+}
+
+// NewProbe returns a probe evaluating the named checks
+func (r *CheckRegistry) NewProbe(names []string, latch bool) (*Probe, error) {
+	p := Probe{
+		checks: make([]Checker, len(names)),
+		latch:  latch,
+	}
+	for i, name := range names {
+		c := r.Get(name)
+		if c == nil {
+			return nil, fmt.Errorf("unknown health check: %s", name)
+		}
+		p.checks[i] = c
+	}
+	return &p, nil
+}
+
+// inherit keeps the latched state of the replaced probe
+func (p *Probe) inherit(old *Probe) {
+	old.mtx.Lock()
+	passed := old.passed
+	old.mtx.Unlock()
+	p.mtx.Lock()
+	p.passed = p.latch && passed
+	p.mtx.Unlock()
+}
+
+func (p *Probe) Evaluate() *ProbeReport {
+	report := ProbeReport{
+		OK:     true,
+		Checks: make([]*CheckResult, len(p.checks)),
+	}
+	for i, c := range p.checks {
+		res := c.Evaluate()
+		res.Name = c.Name()
+		res.Mode = CheckRequired
+		report.Checks[i] = res
+		if res.Status == CheckFail {
+			report.OK = false
+		}
+	}
+	if p.latch {
+		p.mtx.Lock()
+		p.passed = p.passed || report.OK
+		report.OK = p.passed
+		p.mtx.Unlock()
+	}
+	return &report
+}
+
+func (p *Probe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := p.Evaluate()
+	code := http.StatusOK
+	if !report.OK {
+		code = http.StatusServiceUnavailable
+	}
+	if isVerbose(r) {
+		writeJSON(w, code, report)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	if report.OK {
+		fmt.Fprintln(w, "ok")
+	} else {
+		fmt.Fprintln(w, "failed")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+type ProxyConfig struct {
+	Listen string
+	URL    string
+	// HealthFunc returns false if the requests must be rejected
+	HealthFunc func() bool
+	Filter     *PathFilter
+	Reg        prometheus.Registerer
+	Logger     log.FieldLogger
+}
+
+// Proxy is a reverse proxy forwarding RPC requests to the node while it's healthy
+type Proxy struct {
+	cfg    ProxyConfig
+	srv    *http.Server
+	proxy  *httputil.ReverseProxy
+	metric *prometheus.HistogramVec
+	// cancel aborts the proxied requests including streaming ones
+	cancel context.CancelFunc
+}
+
+func (c *ProxyConfig) New() (*Proxy, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{
+		cfg: *c,
+		metric: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "tezos",
+			Subsystem: "proxy",
+			Name:      "request_duration_seconds",
+			Help:      "Proxied RPC request latency.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "path", "code"}),
+	}
+	if c.Reg != nil {
+		c.Reg.MustRegister(p.metric)
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(u)
+			r.SetXForwarded()
+		},
+		// flush immediately to support streaming endpoints like /monitor/heads
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if !errors.Is(err, context.Canceled) {
+				p.cfg.Logger.Error(err)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	var h http.Handler = p
+	if c.Filter != nil {
+		h = c.Filter.Handler(h)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.srv = &http.Server{
+		Handler:     h,
+		Addr:        c.Listen,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	p.srv.RegisterOnShutdown(cancel)
+	return p, nil
+}
+
+func (p *Proxy) Start() {
+	go func() {
+		p.cfg.Logger.Infof("Proxy listening on %s", p.cfg.Listen)
+		if err := p.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			p.cfg.Logger.Error(err)
+		}
+	}()
+}
+
+func (p *Proxy) Stop(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+	if err := p.srv.Shutdown(ctx); err != nil {
+		p.cancel()
+		return errors.Join(err, p.srv.Close())
+	}
+	return nil
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	timestamp := time.Now()
+	rw := newResponseStatusWriter(w)
+
+	if p.cfg.HealthFunc != nil && !p.cfg.HealthFunc() {
+		writeJSON(rw, http.StatusServiceUnavailable, map[string]string{"error": "node is unhealthy"})
+	} else {
+		p.proxy.ServeHTTP(rw, r)
+	}
+
+	// only the paths routed by the node are used as is, the rest would let clients create arbitrary series
+	path := otherPath
+	if rw.Status() < 400 {
+		path = normalizePath(r.URL.Path)
+	}
+	p.metric.With(prometheus.Labels{
+		"method": r.Method,
+		"path":   path,
+		"code":   strconv.Itoa(rw.Status()),
+	}).Observe(time.Since(timestamp).Seconds())
+}
+
+// otherPath is the metric label of unrouted and unrecognized paths
+const otherPath = "{other}"
+
+var (
+	numRegexp  = regexp.MustCompile(`^\d+$`)
+	wordRegexp = regexp.MustCompile(`^[a-z0-9_]*$`)
+	hashRegexp = regexp.MustCompile(`^[1-9A-HJ-NP-Za-km-z]{20,}$`)
+	relRegexp  = regexp.MustCompile(`^(.*)([~+-])\d+$`)
+)
+
+// normalizePath replaces levels, hashes and addresses in the path with placeholders to keep the metric cardinality low.
+// Segments which don't look like RPC path components are replaced with {other}
+func normalizePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		switch {
+		case numRegexp.MatchString(s):
+			segments[i] = "{num}"
+		case hashRegexp.MatchString(s):
+			segments[i] = "{id}"
+		default:
+			if m := relRegexp.FindStringSubmatch(s); m != nil {
+				switch base := m[1]; {
+				case hashRegexp.MatchString(base):
+					segments[i] = "{id}" + m[2] + "{num}"
+				case wordRegexp.MatchString(base):
+					segments[i] = base + m[2] + "{num}"
+				default:
+					segments[i] = otherPath
+				}
+			} else if !wordRegexp.MatchString(s) {
+				segments[i] = otherPath
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
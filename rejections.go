@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"time"
+
+	tz "github.com/ecadlabs/gotez/v2"
+	"github.com/ecadlabs/gotez/v2/clientv2/mempool"
+)
+
+// unknownErrorID labels the operations with an error payload which can't be parsed
+const unknownErrorID = "unknown"
+
+// maxErrorNesting limits the length prefixes unwrapped while looking for the errors' JSON
+const maxErrorNesting = 2
+
+// RejectedOperation is a mempool operation refused by the node along with the error trace
+type RejectedOperation struct {
+	Hash *tz.OperationHash `json:"hash"`
+	Pool string            `json:"pool"`
+	// ErrorIDs are the short error identifiers of the trace, the outermost first
+	ErrorIDs []string          `json:"error_ids"`
+	Errors   []json.RawMessage `json:"errors,omitempty"`
+}
+
+// MempoolRejections is the report returned by `/mempool/rejections`
+type MempoolRejections struct {
+	Updated    time.Time            `json:"updated"`
+	Operations []*RejectedOperation `json:"operations"`
+}
+
+// parseErrorTrace extracts the errors' JSON objects from the payload. In the binary encoding each error
+// of the trace is a length prefixed JSON document
+func parseErrorTrace(data []byte, depth int) []json.RawMessage {
+	if d := bytes.TrimSpace(data); len(d) != 0 && (d[0] == '[' || d[0] == '{') {
+		if d[0] == '{' {
+			d = append(append([]byte{'['}, d...), ']')
+		}
+		var out []json.RawMessage
+		if err := json.Unmarshal(d, &out); err != nil {
+			return nil
+		}
+		return out
+	}
+	if depth >= maxErrorNesting {
+		return nil
+	}
+	var out []json.RawMessage
+	for len(data) >= 4 {
+		n := binary.BigEndian.Uint32(data)
+		if uint64(n) > uint64(len(data)-4) {
+			return nil
+		}
+		out = append(out, parseErrorTrace(data[4:4+n], depth+1)...)
+		data = data[4+n:]
+	}
+	if len(data) != 0 {
+		return nil
+	}
+	return out
+}
+
+// shortErrorID strips the protocol prefix to keep the label stable across protocol upgrades,
+// e.g. `proto.019-PtParisB.contract.counter_in_the_past` becomes `contract.counter_in_the_past`
+func shortErrorID(id string) string {
+	if rest, ok := strings.CutPrefix(id, "proto."); ok {
+		if _, short, ok := strings.Cut(rest, "."); ok {
+			return short
+		}
+	}
+	return id
+}
+
+func errorIDs(trace []json.RawMessage) []string {
+	ids := make([]string, 0, len(trace))
+	for _, e := range trace {
+		var v struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(e, &v); err == nil && v.ID != "" {
+			ids = append(ids, shortErrorID(v.ID))
+		}
+	}
+	return ids
+}
+
+// compareRejected orders the operations by hash, the ones without a hash go first
+func compareRejected(a, b *RejectedOperation) int {
+	var x, y []byte
+	if a.Hash != nil {
+		x = a.Hash[:]
+	}
+	if b.Hash != nil {
+		y = b.Hash[:]
+	}
+	return bytes.Compare(x, y)
+}
+
+// newRejectedOperation classifies the operation by the outermost error of its trace
+func newRejectedOperation(pool string, list *mempool.PendingOperationsListWithError) *RejectedOperation {
+	trace := parseErrorTrace(list.Error, 0)
+	op := RejectedOperation{
+		Hash:     list.Hash,
+		Pool:     pool,
+		ErrorIDs: errorIDs(trace),
+		Errors:   trace,
+	}
+	if len(op.ErrorIDs) == 0 {
+		op.ErrorIDs = []string{unknownErrorID}
+	}
+	return &op
+}
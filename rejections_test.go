@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+
+	tz "github.com/ecadlabs/gotez/v2"
+	"github.com/ecadlabs/gotez/v2/clientv2/mempool"
+)
+
+func lengthPrefixed(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = binary.BigEndian.AppendUint32(out, uint32(len(p)))
+		out = append(out, p...)
+	}
+	return out
+}
+
+func TestParseErrorTrace(t *testing.T) {
+	var (
+		counter = []byte(`{"kind":"temporary","id":"proto.019-PtParisB.contract.counter_in_the_past","contract":"tz1"}`)
+		balance = []byte(`{"kind":"temporary","id":"proto.019-PtParisB.tez.subtraction_underflow"}`)
+		node    = []byte(`{"kind":"permanent","id":"node.prevalidation.oversized_operation"}`)
+		both    = []byte(`[` + string(counter) + `,` + string(balance) + `]`)
+	)
+	tests := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{"empty", nil, nil},
+		{"json object", counter, []string{"contract.counter_in_the_past"}},
+		{"json array", both, []string{"contract.counter_in_the_past", "tez.subtraction_underflow"}},
+		{"json with whitespace", append([]byte(" \n"), both...), []string{"contract.counter_in_the_past", "tez.subtraction_underflow"}},
+		{"invalid json", []byte(`[{"id":`), nil},
+		{"prefixed object", lengthPrefixed(counter), []string{"contract.counter_in_the_past"}},
+		{"prefixed array", lengthPrefixed(both), []string{"contract.counter_in_the_past", "tez.subtraction_underflow"}},
+		{"prefixed sequence", lengthPrefixed(counter, node), []string{"contract.counter_in_the_past", "node.prevalidation.oversized_operation"}},
+		{"prefixed sequence of mixed payloads", lengthPrefixed(both, node), []string{"contract.counter_in_the_past", "tez.subtraction_underflow", "node.prevalidation.oversized_operation"}},
+		{"nested prefixes", lengthPrefixed(lengthPrefixed(counter, balance)), []string{"contract.counter_in_the_past", "tez.subtraction_underflow"}},
+		{"nested and plain prefixes", lengthPrefixed(lengthPrefixed(counter), node), []string{"contract.counter_in_the_past", "node.prevalidation.oversized_operation"}},
+		{"too deeply nested", lengthPrefixed(lengthPrefixed(lengthPrefixed(counter))), nil},
+		{"length overflow", binary.BigEndian.AppendUint32(nil, 1000), nil},
+		{"truncated payload", lengthPrefixed(counter)[:len(counter)], nil},
+		{"trailing bytes", append(lengthPrefixed(counter), 0, 0), nil},
+		{"invalid prefixed json", lengthPrefixed([]byte(`{"id":`)), nil},
+		{"binary garbage", []byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trace := parseErrorTrace(tt.data, 0)
+			if ids := errorIDs(trace); !slices.Equal(ids, tt.want) {
+				t.Errorf("error IDs %v, want %v", ids, tt.want)
+			}
+			if len(trace) != len(tt.want) {
+				t.Errorf("%d errors, want %d", len(trace), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestShortErrorID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"proto.019-PtParisB.contract.counter_in_the_past", "contract.counter_in_the_past"},
+		{"proto.alpha.gas_exhausted.operation", "gas_exhausted.operation"},
+		{"node.prevalidation.oversized_operation", "node.prevalidation.oversized_operation"},
+		{"proto.", "proto."},
+		{"proto.019-PtParisB", "proto.019-PtParisB"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := shortErrorID(tt.id); got != tt.want {
+			t.Errorf("shortErrorID(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestNewRejectedOperation(t *testing.T) {
+	list := mempool.PendingOperationsListWithError{Error: []byte("garbage")}
+	if op := newRejectedOperation("refused", &list); !slices.Equal(op.ErrorIDs, []string{unknownErrorID}) || op.Pool != "refused" {
+		t.Errorf("unexpected operation %+v", op)
+	}
+	list.Error = lengthPrefixed([]byte(`{"id":"proto.019-PtParisB.contract.counter_in_the_past"}`))
+	if op := newRejectedOperation("outdated", &list); !slices.Equal(op.ErrorIDs, []string{"contract.counter_in_the_past"}) || len(op.Errors) != 1 {
+		t.Errorf("unexpected operation %+v", op)
+	}
+}
+
+func TestCompareRejected(t *testing.T) {
+	ops := []*RejectedOperation{
+		{Hash: &tz.OperationHash{3}},
+		{Hash: &tz.OperationHash{1, 2}},
+		{},
+		{Hash: &tz.OperationHash{1, 1}},
+	}
+	slices.SortFunc(ops, compareRejected)
+	want := []*tz.OperationHash{nil, {1, 1}, {1, 2}, {3}}
+	for i, op := range ops {
+		if (op.Hash == nil) != (want[i] == nil) || op.Hash != nil && *op.Hash != *want[i] {
+			t.Errorf("operation %d: %v, want %v", i, op.Hash, want[i])
+		}
+	}
+}
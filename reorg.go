@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	tz "github.com/ecadlabs/gotez/v2"
+	"github.com/ecadlabs/gotez/v2/protocol/core"
+	log "github.com/sirupsen/logrus"
+)
+
+var reorgDepthBuckets = []float64{1, 2, 3, 4, 5, 8, 16, 32, 64}
+
+type chainBlock struct {
+	level       int32
+	hash        *tz.BlockHash
+	predecessor *tz.BlockHash
+}
+
+// Reorg describes a switch to another branch
+type Reorg struct {
+	Level int32 `json:"level"`
+	// Depth is the number of blocks removed from the main branch. If the common ancestor is
+	// outside of the tracked window it's the lower bound
+	Depth    int32           `json:"depth"`
+	OldHead  *tz.BlockHash   `json:"old_head"`
+	NewHead  *tz.BlockHash   `json:"new_head"`
+	Ancestor *tz.BlockHash   `json:"ancestor,omitempty"`
+	Orphaned []*tz.BlockHash `json:"orphaned"`
+	Time     time.Time       `json:"time"`
+}
+
+// headChain is a window of the most recent blocks of the main branch in the ascending order
+type headChain struct {
+	size   int
+	blocks []*chainBlock
+}
+
+func (c *headChain) head() *chainBlock {
+	if len(c.blocks) == 0 {
+		return nil
+	}
+	return c.blocks[len(c.blocks)-1]
+}
+
+func (c *headChain) find(hash *tz.BlockHash) int {
+	for i := len(c.blocks) - 1; i >= 0; i-- {
+		if *c.blocks[i].hash == *hash {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *headChain) push(blocks ...*chainBlock) {
+	c.blocks = append(c.blocks, blocks...)
+	if len(c.blocks) > c.size {
+		c.blocks = append(c.blocks[:0:0], c.blocks[len(c.blocks)-c.size:]...)
+	}
+}
+
+// update adds the new head along with its missing ancestors fetched using getHeader. It returns non nil
+// if the new head doesn't descend from the previous one
+func (c *headChain) update(b *chainBlock, getHeader func(*tz.BlockHash) (*core.ShellHeader, error)) (*Reorg, error) {
+	prev := c.head()
+	if prev == nil {
+		c.push(b)
+		return nil, nil
+	}
+	if *prev.hash == *b.hash {
+		return nil, nil
+	}
+	if b.level-prev.level >= int32(c.size) {
+		// too many heads were missed to tell
+		c.blocks = nil
+		c.push(b)
+		return nil, nil
+	}
+
+	// walk back until a known block is met
+	branch := []*chainBlock{b}
+	ancestor := -1
+	minLevel := c.blocks[0].level
+	for cur := b; ; {
+		if ancestor = c.find(cur.predecessor); ancestor >= 0 || cur.level <= minLevel || len(branch) > c.size {
+			break
+		}
+		sh, err := getHeader(cur.predecessor)
+		if err != nil {
+			return nil, err
+		}
+		cur = &chainBlock{level: sh.Level, hash: cur.predecessor, predecessor: sh.Predecessor}
+		branch = append(branch, cur)
+	}
+	for i, j := 0, len(branch)-1; i < j; i, j = i+1, j-1 {
+		branch[i], branch[j] = branch[j], branch[i]
+	}
+
+	if ancestor == len(c.blocks)-1 {
+		// missed heads
+		c.push(branch...)
+		return nil, nil
+	}
+	r := Reorg{
+		Level:   b.level,
+		OldHead: prev.hash,
+		NewHead: b.hash,
+		Time:    time.Now(),
+	}
+	var orphaned []*chainBlock
+	if ancestor >= 0 {
+		r.Ancestor = c.blocks[ancestor].hash
+		r.Depth = prev.level - c.blocks[ancestor].level
+		orphaned = c.blocks[ancestor+1:]
+		c.blocks = c.blocks[:ancestor+1]
+	} else {
+		r.Depth = prev.level - minLevel + 1
+		orphaned = c.blocks
+		c.blocks = nil
+	}
+	r.Orphaned = make([]*tz.BlockHash, len(orphaned))
+	for i, o := range orphaned {
+		r.Orphaned[i] = o.hash
+	}
+	c.push(branch...)
+	return &r, nil
+}
+
+// trackHead updates the window of recent blocks and reports reorganizations
+func (h *HeadMonitor) trackHead(ctx context.Context, hash *tz.BlockHash, sh *core.ShellHeader) error {
+	h.mtx.Lock()
+	chain := headChain{size: h.cfg.ReorgWindow, blocks: h.chain}
+	h.mtx.Unlock()
+
+	r, err := chain.update(&chainBlock{level: sh.Level, hash: hash, predecessor: sh.Predecessor}, func(b *tz.BlockHash) (*core.ShellHeader, error) {
+		return h.getShellHeader(ctx, b)
+	})
+	if err != nil {
+		return err
+	}
+
+	h.mtx.Lock()
+	h.chain = chain.blocks
+	if r != nil {
+		h.lastReorg = r
+		if h.cfg.MaxReorgDepth > 0 && r.Depth > h.cfg.MaxReorgDepth {
+			h.deepReorg = r
+		}
+	}
+	h.mtx.Unlock()
+	if r == nil {
+		return nil
+	}
+
+	h.reorgCounter.Inc()
+	h.reorgHistogram.Observe(float64(r.Depth))
+	h.cfg.Logger.WithFields(log.Fields{
+		"level":    r.Level,
+		"depth":    r.Depth,
+		"old_head": r.OldHead,
+		"new_head": r.NewHead,
+		"ancestor": r.Ancestor,
+		"orphaned": r.Orphaned,
+	}).Warn("chain reorganization")
+	h.publish(EventReorg, r)
+	return nil
+}
+
+// ReorgChecker returns a check of the recent reorganizations' depth
+func (h *HeadMonitor) ReorgChecker() Checker {
+	return (*reorgChecker)(h)
+}
+
+type reorgChecker HeadMonitor
+
+func (c *reorgChecker) Name() string {
+	return "reorg"
+}
+
+func (c *reorgChecker) Metadata() *CheckMetadata {
+	return &CheckMetadata{
+		Description: "No reorganization deeper than max_reorg_depth happened within reorg_hold",
+	}
+}
+
+func (c *reorgChecker) Evaluate() *CheckResult {
+	c.mtx.RLock()
+	last, deep := c.lastReorg, c.deepReorg
+	c.mtx.RUnlock()
+	res := CheckResult{
+		Status:    CheckPass,
+		Value:     int32(0),
+		Threshold: c.cfg.MaxReorgDepth,
+	}
+	if last != nil {
+		res.Value, res.Updated = last.Depth, last.Time
+	}
+	if deep != nil && time.Since(deep.Time) < c.cfg.ReorgHold {
+		res.Status = CheckFail
+		res.Value, res.Updated = deep.Depth, deep.Time
+		res.Reason = fmt.Sprintf("%d blocks were reorganized at level %d", deep.Depth, deep.Level)
+	}
+	return &res
+}
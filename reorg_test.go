@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	tz "github.com/ecadlabs/gotez/v2"
+	"github.com/ecadlabs/gotez/v2/protocol/core"
+)
+
+func testBlockHash(name string) *tz.BlockHash {
+	var h tz.BlockHash
+	copy(h[:], name)
+	return &h
+}
+
+func testBlock(name string, level int32, predecessor string) *chainBlock {
+	return &chainBlock{level: level, hash: testBlockHash(name), predecessor: testBlockHash(predecessor)}
+}
+
+func hashName(h *tz.BlockHash) string {
+	if h == nil {
+		return ""
+	}
+	n := slices.Index(h[:], 0)
+	if n < 0 {
+		n = len(h)
+	}
+	return string(h[:n])
+}
+
+func TestHeadChainUpdate(t *testing.T) {
+	errFetch := errors.New("fetch failed")
+	type reorg struct {
+		depth    int32
+		ancestor string
+		orphaned []string
+	}
+	tests := []struct {
+		name   string
+		size   int
+		window []*chainBlock
+		head   *chainBlock
+		// headers are returned by getHeader, the missing ones fail
+		headers []*chainBlock
+		reorg   *reorg
+		err     error
+		// result is the window after the update
+		result  []string
+		fetched []string
+	}{
+		{
+			name:   "first head",
+			size:   4,
+			head:   testBlock("a1", 1, "a0"),
+			result: []string{"a1"},
+		},
+		{
+			name:   "same head",
+			size:   4,
+			window: []*chainBlock{testBlock("a1", 1, "a0"), testBlock("a2", 2, "a1")},
+			head:   testBlock("a2", 2, "a1"),
+			result: []string{"a1", "a2"},
+		},
+		{
+			name:   "next head",
+			size:   2,
+			window: []*chainBlock{testBlock("a1", 1, "a0"), testBlock("a2", 2, "a1")},
+			head:   testBlock("a3", 3, "a2"),
+			result: []string{"a2", "a3"},
+		},
+		{
+			name:   "same level round change",
+			size:   4,
+			window: []*chainBlock{testBlock("a1", 1, "a0"), testBlock("a2", 2, "a1")},
+			head:   testBlock("b2", 2, "a1"),
+			reorg:  &reorg{depth: 1, ancestor: "a1", orphaned: []string{"a2"}},
+			result: []string{"a1", "b2"},
+		},
+		{
+			name:   "same level round change of the oldest block",
+			size:   2,
+			window: []*chainBlock{testBlock("a2", 2, "a1"), testBlock("a3", 3, "a2")},
+			head:   testBlock("b3", 3, "a2"),
+			reorg:  &reorg{depth: 1, ancestor: "a2", orphaned: []string{"a3"}},
+			result: []string{"a2", "b3"},
+		},
+		{
+			name:    "missed heads",
+			size:    8,
+			window:  []*chainBlock{testBlock("a1", 1, "a0"), testBlock("a2", 2, "a1")},
+			head:    testBlock("a5", 5, "a4"),
+			headers: []*chainBlock{testBlock("a4", 4, "a3"), testBlock("a3", 3, "a2")},
+			result:  []string{"a1", "a2", "a3", "a4", "a5"},
+			fetched: []string{"a4", "a3"},
+		},
+		{
+			name:    "missed heads overflowing the window",
+			size:    3,
+			window:  []*chainBlock{testBlock("a1", 1, "a0"), testBlock("a2", 2, "a1")},
+			head:    testBlock("a4", 4, "a3"),
+			headers: []*chainBlock{testBlock("a3", 3, "a2")},
+			result:  []string{"a2", "a3", "a4"},
+			fetched: []string{"a3"},
+		},
+		{
+			name:   "too many missed heads",
+			size:   3,
+			window: []*chainBlock{testBlock("a1", 1, "a0"), testBlock("a2", 2, "a1")},
+			head:   testBlock("a5", 5, "a4"),
+			result: []string{"a5"},
+		},
+		{
+			name:    "reorg with missed heads",
+			size:    8,
+			window:  []*chainBlock{testBlock("a1", 1, "a0"), testBlock("a2", 2, "a1"), testBlock("a3", 3, "a2")},
+			head:    testBlock("b4", 4, "b3"),
+			headers: []*chainBlock{testBlock("b3", 3, "a2")},
+			reorg:   &reorg{depth: 1, ancestor: "a2", orphaned: []string{"a3"}},
+			result:  []string{"a1", "a2", "b3", "b4"},
+			fetched: []string{"b3"},
+		},
+		{
+			name:   "reorg to a lower level",
+			size:   8,
+			window: []*chainBlock{testBlock("a1", 1, "a0"), testBlock("a2", 2, "a1"), testBlock("a3", 3, "a2")},
+			head:   testBlock("b2", 2, "a1"),
+			reorg:  &reorg{depth: 2, ancestor: "a1", orphaned: []string{"a2", "a3"}},
+			result: []string{"a1", "b2"},
+		},
+		{
+			name:    "ancestor outside the window",
+			size:    3,
+			window:  []*chainBlock{testBlock("a3", 3, "a2"), testBlock("a4", 4, "a3"), testBlock("a5", 5, "a4")},
+			head:    testBlock("b5", 5, "b4"),
+			headers: []*chainBlock{testBlock("b4", 4, "b3"), testBlock("b3", 3, "a2")},
+			reorg:   &reorg{depth: 3, orphaned: []string{"a3", "a4", "a5"}},
+			result:  []string{"b3", "b4", "b5"},
+			fetched: []string{"b4", "b3"},
+		},
+		{
+			name:    "fetch error",
+			size:    8,
+			window:  []*chainBlock{testBlock("a1", 1, "a0"), testBlock("a2", 2, "a1")},
+			head:    testBlock("a4", 4, "a3"),
+			err:     errFetch,
+			result:  []string{"a1", "a2"},
+			fetched: []string{"a3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := headChain{size: tt.size, blocks: slices.Clone(tt.window)}
+			var fetched []string
+			r, err := chain.update(tt.head, func(h *tz.BlockHash) (*core.ShellHeader, error) {
+				fetched = append(fetched, hashName(h))
+				for _, b := range tt.headers {
+					if *b.hash == *h {
+						return &core.ShellHeader{Level: b.level, Predecessor: b.predecessor}, nil
+					}
+				}
+				return nil, errFetch
+			})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if !slices.Equal(fetched, tt.fetched) {
+				t.Errorf("fetched %v, want %v", fetched, tt.fetched)
+			}
+			var result []string
+			for _, b := range chain.blocks {
+				result = append(result, hashName(b.hash))
+			}
+			if !slices.Equal(result, tt.result) {
+				t.Errorf("window %v, want %v", result, tt.result)
+			}
+			if tt.reorg == nil {
+				if r != nil {
+					t.Fatalf("unexpected reorg %+v", r)
+				}
+				return
+			}
+			if r == nil {
+				t.Fatal("reorg expected")
+			}
+			if r.Depth != tt.reorg.depth {
+				t.Errorf("depth %d, want %d", r.Depth, tt.reorg.depth)
+			}
+			if got := hashName(r.Ancestor); got != tt.reorg.ancestor {
+				t.Errorf("ancestor %q, want %q", got, tt.reorg.ancestor)
+			}
+			var orphaned []string
+			for _, h := range r.Orphaned {
+				orphaned = append(orphaned, hashName(h))
+			}
+			if !slices.Equal(orphaned, tt.reorg.orphaned) {
+				t.Errorf("orphaned %v, want %v", orphaned, tt.reorg.orphaned)
+			}
+			if *r.OldHead != *tt.window[len(tt.window)-1].hash || *r.NewHead != *tt.head.hash || r.Level != tt.head.level {
+				t.Errorf("unexpected heads %+v", r)
+			}
+		})
+	}
+}
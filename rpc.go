@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+
+	tz "github.com/ecadlabs/gotez/v2"
+	client "github.com/ecadlabs/gotez/v2/clientv2"
+)
+
+// getJSON performs a JSON RPC request. It's used for the endpoints not covered by the client library
+func getJSON(ctx context.Context, cl *client.Client, path string, out any) error {
+	u, err := url.Parse(cl.URL)
+	if err != nil {
+		return err
+	}
+	u.Path = path
+	if cl.DebugLogger != nil {
+		cl.DebugLogger.Printf("GET %s", u)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if cl.APIKey != "" {
+		req.Header.Add("X-Api-Key", cl.APIKey)
+	}
+	httpClient := cl.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		e := &client.Error{
+			Status: res.StatusCode,
+			Raw:    res,
+		}
+		if body, err := io.ReadAll(res.Body); err == nil {
+			e.Body = body
+		}
+		return e
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// getChainID returns the ID of the node's main chain
+func getChainID(ctx context.Context, cl *client.Client) (*tz.ChainID, error) {
+	var id tz.ChainID
+	if err := getJSON(ctx, cl, "/chains/main/chain_id", &id); err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Sidecar owns the monitored nodes and the global services and applies configuration changes at runtime
+type Sidecar struct {
+	src           *ConfigSource
+	reg           *prometheus.Registry
+	events        *EventBus
+	filterMetric  *prometheus.CounterVec
+	webhookMetric *prometheus.CounterVec
+
+	// reloadMtx serializes reloads
+	reloadMtx sync.Mutex
+
+	mtx      sync.RWMutex
+	conf     *Config
+	nodes    []*Node
+	filter   *PathFilter
+	webhooks []*Webhook
+	history  *History
+	slo      *SLO
+	running  bool
+}
+
+// NewSidecar creates the nodes described by the configuration. src is used for reloading
+func NewSidecar(ctx context.Context, src *ConfigSource, conf *Config) (*Sidecar, error) {
+	reg := prometheus.NewRegistry()
+	s := &Sidecar{
+		src:           src,
+		reg:           reg,
+		events:        NewEventBus(conf.EventBuffer),
+		filterMetric:  newFilterMetric(reg),
+		webhookMetric: newWebhookMetric(reg),
+	}
+	s.slo = conf.SLO.New(s.events, reg)
+	if _, err := s.update(ctx, conf); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Sidecar) Start() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.running = true
+	if s.history != nil {
+		s.history.Start()
+	}
+	// the recorded transitions are loaded from the history
+	s.slo.Start(s.history)
+	for _, wh := range s.webhooks {
+		wh.Start()
+	}
+	for _, n := range s.nodes {
+		n.Start()
+	}
+}
+
+func (s *Sidecar) Stop(ctx context.Context) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.running = false
+	var errs []error
+	for _, n := range s.nodes {
+		errs = append(errs, n.Stop(ctx))
+	}
+	for _, wh := range s.webhooks {
+		errs = append(errs, wh.Stop(ctx))
+	}
+	errs = append(errs, s.slo.Stop(ctx))
+	if s.history != nil {
+		errs = append(errs, s.history.Stop(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// Reload re-reads the configuration and applies the changes. It returns the list of changed fields
+func (s *Sidecar) Reload(ctx context.Context) ([]string, error) {
+	conf, err := s.src.Load()
+	if err != nil {
+		return nil, err
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return s.update(ctx, conf)
+}
+
+// update applies the new configuration. Nothing is changed if any of the nodes fails to prepare its monitors
+func (s *Sidecar) update(ctx context.Context, conf *Config) ([]string, error) {
+	s.reloadMtx.Lock()
+	defer s.reloadMtx.Unlock()
+
+	s.mtx.RLock()
+	oldConf, oldNodes, oldWebhooks, oldHistory, running := s.conf, s.nodes, s.webhooks, s.history, s.running
+	s.mtx.RUnlock()
+
+	var diff []string
+	if oldConf != nil {
+		diff = oldConf.Diff(conf)
+		if len(diff) == 0 {
+			log.Info("configuration is unchanged")
+			return nil, nil
+		}
+		for _, d := range diff {
+			log.Info("config changed: " + d)
+		}
+		if conf.Listen != oldConf.Listen {
+			log.Warn("listen: the change requires a restart")
+		}
+		if conf.AdminListen != oldConf.AdminListen {
+			log.Warn("admin_listen: the change requires a restart")
+		}
+		if conf.EventBuffer != oldConf.EventBuffer {
+			log.Warn("event_buffer: the change requires a restart")
+		}
+	}
+
+	current := make(map[string]*Node, len(oldNodes))
+	for _, n := range oldNodes {
+		current[n.Name()] = n
+	}
+	nodeList := conf.NodeList()
+	nodes := make([]*Node, len(nodeList))
+	var (
+		updates []*NodeUpdate
+		added   []*Node
+	)
+	for i, nc := range nodeList {
+		if n, ok := current[nc.Name]; ok {
+			u, err := n.Prepare(conf, nc)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", nc.Name, err)
+			}
+			updates = append(updates, u)
+			delete(current, nc.Name)
+			nodes[i] = n
+			continue
+		}
+		// a new node is not started until the update is committed
+		n, err := conf.NewNode(ctx, nc, s.events, s.filterMetric)
+		if err != nil {
+			return nil, err
+		}
+		added = append(added, n)
+		nodes[i] = n
+	}
+
+	var filter *PathFilter
+	if conf.Filter != nil {
+		var err error
+		if filter, err = conf.Filter.New(conf.Listen, s.filterMetric); err != nil {
+			return nil, err
+		}
+	}
+
+	webhooks := oldWebhooks
+	webhooksChanged := oldConf == nil || !reflect.DeepEqual(oldConf.Webhooks, conf.Webhooks)
+	if webhooksChanged {
+		webhooks = make([]*Webhook, len(conf.Webhooks))
+		for i, wc := range conf.Webhooks {
+			wh, err := wc.New(s.events, s.webhookMetric)
+			if err != nil {
+				return nil, err
+			}
+			webhooks[i] = wh
+		}
+	}
+
+	history := oldHistory
+	historyChanged := oldConf == nil || !reflect.DeepEqual(oldConf.History, conf.History)
+	if historyChanged {
+		history = nil
+		if conf.History != nil {
+			var err error
+			if history, err = conf.History.New(s.events); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// commit
+	var errs []error
+	for _, n := range current {
+		if running {
+			errs = append(errs, n.Stop(ctx))
+		}
+		log.WithField("node", n.Name()).Info("node removed")
+	}
+	for _, u := range updates {
+		errs = append(errs, u.Apply(ctx))
+	}
+	if running {
+		for _, n := range added {
+			n.Start()
+			log.WithField("node", n.Name()).Info("node added")
+		}
+		if webhooksChanged {
+			for _, wh := range oldWebhooks {
+				errs = append(errs, wh.Stop(ctx))
+			}
+			for _, wh := range webhooks {
+				wh.Start()
+			}
+			log.Info("webhooks restarted")
+		}
+		if historyChanged {
+			if oldHistory != nil {
+				errs = append(errs, oldHistory.Stop(ctx))
+			}
+			if history != nil {
+				history.Start()
+			}
+			log.Info("history restarted")
+		}
+	}
+
+	s.slo.Configure(conf.SLO)
+
+	s.mtx.Lock()
+	s.conf, s.nodes, s.filter, s.webhooks, s.history = conf, nodes, filter, webhooks, history
+	s.mtx.Unlock()
+	return diff, errors.Join(errs...)
+}
+
+// Node returns the node by name. An empty name refers to the first node
+func (s *Sidecar) Node(name string) *Node {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	for _, n := range s.nodes {
+		if name == "" || n.Name() == name {
+			return n
+		}
+	}
+	return nil
+}
+
+func (s *Sidecar) gatherers() prometheus.Gatherers {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	out := prometheus.Gatherers{s.reg}
+	for _, n := range s.nodes {
+		out = append(out, n.Gatherers()...)
+	}
+	return out
+}
+
+func (s *Sidecar) Metrics(w http.ResponseWriter, r *http.Request) {
+	// the set of registries changes on reload
+	promhttp.HandlerFor(s.gatherers(), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+func (s *Sidecar) History(w http.ResponseWriter, r *http.Request) {
+	s.mtx.RLock()
+	h := s.history
+	s.mtx.RUnlock()
+	if h == nil {
+		http.Error(w, "history is disabled", http.StatusNotFound)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+func (s *Sidecar) SLO(w http.ResponseWriter, r *http.Request) {
+	s.slo.ServeHTTP(w, r)
+}
+
+func (s *Sidecar) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	diff, err := s.Reload(r.Context())
+	if err != nil {
+		log.Error(err)
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if diff == nil {
+		diff = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"changes": diff})
+}
+
+// Filter is a middleware applying the current path filter of the main listener
+func (s *Sidecar) Filter(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mtx.RLock()
+		f := s.filter
+		s.mtx.RUnlock()
+		if f == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		f.Handler(h).ServeHTTP(w, r)
+	})
+}
+
+func (s *Sidecar) serveNode(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["node"]
+	n := s.Node(name)
+	if name == "" || n == nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.StripPrefix("/nodes/"+name, n).ServeHTTP(w, r)
+}
+
+func (s *Sidecar) serveDefault(w http.ResponseWriter, r *http.Request) {
+	s.Node("").ServeHTTP(w, r)
+}
+
+// RegisterAdminRoutes adds the administrative endpoints. They are served on admin_listen only
+func (s *Sidecar) RegisterAdminRoutes(r *mux.Router) {
+	r.Methods("POST").Path("/admin/reload").HandlerFunc(s.ReloadHandler)
+}
+
+// RegisterRoutes adds the sidecar's endpoints to the router
+func (s *Sidecar) RegisterRoutes(r *mux.Router) {
+	r.Methods("GET").Path("/events").Handler(s.events)
+	r.Methods("GET").Path("/metrics").HandlerFunc(s.Metrics)
+	r.Methods("GET").Path("/history").HandlerFunc(s.History)
+	r.Methods("GET").Path("/slo").HandlerFunc(s.SLO)
+	r.PathPrefix("/nodes/{node}/").HandlerFunc(s.serveNode)
+	// top level endpoints are served by the first node for compatibility
+	r.PathPrefix("/").HandlerFunc(s.serveDefault)
+}
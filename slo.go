@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSLOTarget   = 0.999
+	defaultSLOInterval = time.Minute
+)
+
+var defaultSLOWindows = []time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour, 30 * 24 * time.Hour}
+
+// SLOConfig describes the availability accounting. Healthy and degraded states count as available
+type SLOConfig struct {
+	Windows []time.Duration `yaml:"windows"`
+	// Target is the availability objective, e.g. 0.999
+	Target float64 `yaml:"target"`
+	// Interval is the metrics update interval
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (c *SLOConfig) withDefaults() SLOConfig {
+	var out SLOConfig
+	if c != nil {
+		out = *c
+	}
+	if len(out.Windows) == 0 {
+		out.Windows = defaultSLOWindows
+	}
+	if out.Target == 0 {
+		out.Target = defaultSLOTarget
+	}
+	if out.Interval == 0 {
+		out.Interval = defaultSLOInterval
+	}
+	return out
+}
+
+func (c *SLOConfig) maxWindow() time.Duration {
+	return slices.Max(c.Windows)
+}
+
+// sloPoint is a health state transition. The state lasts until the next point
+type sloPoint struct {
+	time  time.Time
+	state HealthState
+	// known is false after the node has stopped being observed
+	known bool
+}
+
+// SLOWindow is the availability accounting over a single window
+type SLOWindow struct {
+	Window string `json:"window"`
+	// Observed is the amount of time the node's state was known, in seconds
+	Observed float64 `json:"observed_seconds"`
+	// Availability, ErrorBudgetRemaining and BurnRate are null if nothing was observed
+	Availability         *float64 `json:"availability"`
+	ErrorBudgetRemaining *float64 `json:"error_budget_remaining"`
+	BurnRate             *float64 `json:"burn_rate"`
+	Outages              int      `json:"outages"`
+	OutageSeconds        float64  `json:"outage_seconds"`
+}
+
+// SLO accounts the nodes' availability over rolling windows using the health transitions
+type SLO struct {
+	bus *EventBus
+
+	mtx       sync.RWMutex
+	cfg       SLOConfig
+	timelines map[string][]*sloPoint
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	availabilityGauge *prometheus.GaugeVec
+	budgetGauge       *prometheus.GaugeVec
+	burnRateGauge     *prometheus.GaugeVec
+	outagesGauge      *prometheus.GaugeVec
+	outageTimeGauge   *prometheus.GaugeVec
+}
+
+// New returns the availability accounting consuming health events from the bus
+func (c *SLOConfig) New(bus *EventBus, reg prometheus.Registerer) *SLO {
+	labels := []string{"node", "window"}
+	s := &SLO{
+		bus:       bus,
+		cfg:       c.withDefaults(),
+		timelines: make(map[string][]*sloPoint),
+		availabilityGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "slo_availability_ratio",
+			Help:      "Share of the observed time the node was healthy or degraded.",
+		}, labels),
+		budgetGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "slo_error_budget_remaining_ratio",
+			Help:      "Share of the error budget left. Negative if the budget is exhausted.",
+		}, labels),
+		burnRateGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "slo_error_budget_burn_rate",
+			Help:      "Rate of the error budget consumption. 1 means the budget is spent exactly at the end of the window.",
+		}, labels),
+		outagesGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "slo_outages",
+			Help:      "Number of unhealthy periods within the window.",
+		}, labels),
+		outageTimeGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "slo_outage_seconds",
+			Help:      "Total unhealthy time within the window.",
+		}, labels),
+	}
+	if reg != nil {
+		reg.MustRegister(s.availabilityGauge, s.budgetGauge, s.burnRateGauge, s.outagesGauge, s.outageTimeGauge)
+	}
+	return s
+}
+
+// Configure applies the new configuration in place, the recorded transitions are kept
+func (s *SLO) Configure(c *SLOConfig) {
+	s.mtx.Lock()
+	s.cfg = c.withDefaults()
+	s.mtx.Unlock()
+}
+
+func (s *SLO) config() SLOConfig {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.cfg
+}
+
+// Start starts consuming the events. The timelines are seeded from the history if it's not nil
+func (s *SLO) Start(h *History) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	// subscribe before the nodes start and before seeding to not miss anything in between
+	sub := s.bus.NewSubscription(log.WithField("component", "slo"))
+	go s.loop(ctx, h, sub)
+}
+
+func (s *SLO) Stop(ctx context.Context) error {
+	s.cancel()
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *SLO) loop(ctx context.Context, h *History, sub *Subscription) {
+	cfg := s.config()
+	t := time.NewTicker(cfg.Interval)
+	defer func() {
+		t.Stop()
+		close(s.done)
+	}()
+
+	var seeded time.Time
+	if h != nil {
+		var err error
+		if seeded, err = s.seed(h, time.Now().Add(-cfg.maxWindow())); err != nil {
+			log.Errorf("slo: history: %v", err)
+		}
+	}
+	s.updateMetrics()
+
+	for {
+		select {
+		case ev, ok := <-sub.C():
+			for _, ev := range sub.Receive(ev, ok) {
+				if ev.Time.After(seeded) {
+					s.handle(ev)
+				}
+			}
+		case <-t.C:
+			if c := s.config(); c.Interval != cfg.Interval {
+				cfg = c
+				t.Reset(cfg.Interval)
+			}
+			s.updateMetrics()
+		case <-ctx.Done():
+			sub.Close()
+			return
+		}
+	}
+}
+
+// seed loads the recorded health transitions and returns the time of the last one. If the sidecar wasn't
+// stopped cleanly, the observation period is ended at the last recorded event of the node before the restart
+func (s *SLO) seed(h *History, from time.Time) (time.Time, error) {
+	var last time.Time
+	lastSeen := make(map[string]time.Time)
+	err := h.Query(&HistoryQuery{
+		From: from,
+		To:   time.Now(),
+	}, func(rec *HistoryRecord) bool {
+		if rec.Type != EventHealth {
+			lastSeen[rec.Node] = rec.Time
+			return true
+		}
+		var ev HealthEvent
+		if err := json.Unmarshal(rec.Data, &ev); err != nil {
+			return true
+		}
+		if ev.Initial {
+			s.interrupt(rec.Node, lastSeen[rec.Node])
+		}
+		s.add(rec.Node, rec.Time, &ev)
+		lastSeen[rec.Node] = rec.Time
+		last = rec.Time
+		return true
+	})
+	return last, err
+}
+
+// interrupt ends the node's observation period at t unless it was ended by a final event
+func (s *SLO) interrupt(node string, t time.Time) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	points := s.timelines[node]
+	if len(points) == 0 || !points[len(points)-1].known {
+		return
+	}
+	prev := points[len(points)-1]
+	if t.Before(prev.time) {
+		t = prev.time
+	}
+	s.timelines[node] = append(points, &sloPoint{time: t, state: prev.state})
+}
+
+func (s *SLO) handle(ev *Event) {
+	if h, ok := ev.Data.(*HealthEvent); ok {
+		s.add(ev.Node, ev.Time, h)
+	}
+}
+
+func (s *SLO) add(node string, t time.Time, ev *HealthEvent) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.timelines[node] = append(s.timelines[node], &sloPoint{
+		time:  t,
+		state: ev.To,
+		known: !ev.Final,
+	})
+}
+
+// trim drops the points which no longer affect any of the windows. Must be called with the lock held
+func (s *SLO) trim(now time.Time) {
+	start := now.Add(-s.cfg.maxWindow())
+	for node, points := range s.timelines {
+		// keep the last point before the start as it defines the state at the start
+		i := 0
+		for i < len(points)-1 && !points[i+1].time.After(start) {
+			i++
+		}
+		points = points[i:]
+		if len(points) == 1 && !points[0].known && !points[0].time.After(start) {
+			// the node is gone
+			delete(s.timelines, node)
+			continue
+		}
+		s.timelines[node] = points
+	}
+}
+
+func computeSLOWindow(points []*sloPoint, window time.Duration, target float64, now time.Time) *SLOWindow {
+	out := SLOWindow{Window: formatWindow(window)}
+	start := now.Add(-window)
+	var observed, outage time.Duration
+	inOutage := false
+	for i, p := range points {
+		from, to := p.time, now
+		if i < len(points)-1 {
+			to = points[i+1].time
+		}
+		if from.Before(start) {
+			from = start
+		}
+		if !to.After(from) {
+			continue
+		}
+		if !p.known {
+			inOutage = false
+			continue
+		}
+		d := to.Sub(from)
+		observed += d
+		if p.state == HealthUnhealthy {
+			if !inOutage {
+				out.Outages++
+			}
+			outage += d
+			inOutage = true
+		} else {
+			inOutage = false
+		}
+	}
+	out.Observed = observed.Seconds()
+	out.OutageSeconds = outage.Seconds()
+	if observed != 0 {
+		unavailable := outage.Seconds() / observed.Seconds()
+		availability := 1 - unavailable
+		burnRate := unavailable / (1 - target)
+		remaining := 1 - burnRate
+		out.Availability, out.BurnRate, out.ErrorBudgetRemaining = &availability, &burnRate, &remaining
+	}
+	return &out
+}
+
+// formatWindow returns the short window name like "1h" or "7d"
+func formatWindow(d time.Duration) string {
+	const day = 24 * time.Hour
+	switch {
+	case d%time.Hour == 0 && d <= day:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%day == 0:
+		return fmt.Sprintf("%dd", d/day)
+	}
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// Report returns the accounting for every window of the given nodes or all the nodes if the list is empty
+func (s *SLO) Report(nodes []string) map[string][]*SLOWindow {
+	now := time.Now()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.trim(now)
+	out := make(map[string][]*SLOWindow)
+	for node, points := range s.timelines {
+		if len(nodes) != 0 && !slices.Contains(nodes, node) {
+			continue
+		}
+		windows := make([]*SLOWindow, len(s.cfg.Windows))
+		for i, w := range s.cfg.Windows {
+			windows[i] = computeSLOWindow(points, w, s.cfg.Target, now)
+		}
+		out[node] = windows
+	}
+	return out
+}
+
+func (s *SLO) updateMetrics() {
+	report := s.Report(nil)
+	gauges := []*prometheus.GaugeVec{s.availabilityGauge, s.budgetGauge, s.burnRateGauge, s.outagesGauge, s.outageTimeGauge}
+	for _, g := range gauges {
+		g.Reset()
+	}
+	for node, windows := range report {
+		for _, w := range windows {
+			labels := prometheus.Labels{"node": node, "window": w.Window}
+			if w.Availability != nil {
+				s.availabilityGauge.With(labels).Set(*w.Availability)
+				s.budgetGauge.With(labels).Set(*w.ErrorBudgetRemaining)
+				s.burnRateGauge.With(labels).Set(*w.BurnRate)
+			}
+			s.outagesGauge.With(labels).Set(float64(w.Outages))
+			s.outageTimeGauge.With(labels).Set(w.OutageSeconds)
+		}
+	}
+}
+
+// ServeHTTP returns the availability report. The nodes can be selected using `node` query parameter
+func (s *SLO) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := s.Report(r.URL.Query()["node"])
+	writeJSON(w, http.StatusOK, &struct {
+		Target float64                 `json:"target"`
+		Nodes  map[string][]*SLOWindow `json:"nodes"`
+	}{s.config().Target, report})
+}
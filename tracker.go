@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+type HealthTrackerConfig struct {
+	Checks   *CheckRegistry
+	Interval time.Duration
+	// Rise is the number of consecutive evaluations required to move to a better state
+	Rise int
+	// Fall is the number of consecutive evaluations required to move to a worse state
+	Fall int
+	// MinHold is the minimum amount of time between two transitions
+	MinHold time.Duration
+	Reg     prometheus.Registerer
+	Logger  log.FieldLogger
+	Events  EventSink
+}
+
+// HealthTracker periodically evaluates the health checks and applies flap damping to the overall result
+type HealthTracker struct {
+	cfg HealthTrackerConfig
+
+	mtx     sync.RWMutex
+	state   HealthState
+	since   time.Time
+	pending HealthState
+	count   int
+	// checks holds the last known status of every check
+	checks map[string]CheckStatus
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	stateGauge        prometheus.Gauge
+	transitionCounter *prometheus.CounterVec
+}
+
+func (c *HealthTrackerConfig) New() *HealthTracker {
+	t := &HealthTracker{
+		cfg:     *c,
+		state:   HealthUnhealthy,
+		pending: HealthUnhealthy,
+		since:   time.Now(),
+		checks:  make(map[string]CheckStatus),
+		stateGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "health_status",
+			Help:      "Overall health status after flap damping: 0 unhealthy, 1 degraded, 2 healthy.",
+		}),
+		transitionCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "tezos",
+			Subsystem: "node",
+			Name:      "health_transitions_total",
+			Help:      "The total number of overall health status transitions.",
+		}, []string{"from", "to"}),
+	}
+	if c.Reg != nil {
+		c.Reg.MustRegister(t.stateGauge)
+		c.Reg.MustRegister(t.transitionCounter)
+	}
+	return t
+}
+
+func (t *HealthTracker) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	t.done = make(chan struct{})
+	go t.loop(ctx)
+}
+
+func (t *HealthTracker) Stop(ctx context.Context) error {
+	t.cancel()
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Configure replaces the checks and the damping parameters keeping the current state
+func (t *HealthTracker) Configure(c *HealthTrackerConfig) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.cfg.Checks = c.Checks
+	t.cfg.Interval = c.Interval
+	t.cfg.Rise = c.Rise
+	t.cfg.Fall = c.Fall
+	t.cfg.MinHold = c.MinHold
+}
+
+func (t *HealthTracker) config() (*CheckRegistry, time.Duration) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.cfg.Checks, t.cfg.Interval
+}
+
+// State returns the damped health state and the time of the last transition
+func (t *HealthTracker) State() (HealthState, time.Time) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.state, t.since
+}
+
+// Report evaluates the checks and returns the report carrying the damped health state
+func (t *HealthTracker) Report() *HealthReport {
+	checks, _ := t.config()
+	report := checks.Evaluate()
+	report.Observed = report.Status
+	report.Status, report.Since = t.State()
+	return report
+}
+
+func (t *HealthTracker) loop(ctx context.Context) {
+	_, interval := t.config()
+	tick := time.NewTicker(interval)
+	defer func() {
+		tick.Stop()
+		close(t.done)
+	}()
+
+	for initial := true; ; initial = false {
+		checks, i := t.config()
+		if i != interval {
+			interval = i
+			tick.Reset(interval)
+		}
+		report := checks.Evaluate()
+		t.updateChecks(report.Checks)
+		t.update(report.Status, initial)
+
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			// mark the end of observations
+			if t.cfg.Events != nil {
+				s, _ := t.State()
+				t.cfg.Events.Publish(EventHealth, &HealthEvent{From: s, To: s, Final: true})
+			}
+			return
+		}
+	}
+}
+
+// updateChecks publishes the individual checks' status changes
+func (t *HealthTracker) updateChecks(results []*CheckResult) {
+	var events []*CheckEvent
+	t.mtx.Lock()
+	for _, res := range results {
+		prev, ok := t.checks[res.Name]
+		t.checks[res.Name] = res.Status
+		if ok && prev != res.Status {
+			events = append(events, &CheckEvent{
+				Name:     res.Name,
+				Status:   res.Status,
+				Previous: prev,
+				Mode:     res.Mode,
+				Reason:   res.Reason,
+			})
+		}
+	}
+	t.mtx.Unlock()
+
+	if t.cfg.Events != nil {
+		for _, ev := range events {
+			t.cfg.Events.Publish(EventCheck, ev)
+		}
+	}
+}
+
+// update applies the observed state. The initial update is always published to mark the start of observations
+func (t *HealthTracker) update(observed HealthState, initial bool) {
+	t.mtx.Lock()
+	from := t.state
+	changed := t.transition(observed)
+	to := t.state
+	t.mtx.Unlock()
+
+	if changed {
+		t.stateGauge.Set(float64(to))
+		t.transitionCounter.With(prometheus.Labels{"from": from.String(), "to": to.String()}).Inc()
+		t.cfg.Logger.WithFields(log.Fields{"from": from, "to": to}).Info("health status changed")
+	}
+	if (changed || initial) && t.cfg.Events != nil {
+		t.cfg.Events.Publish(EventHealth, &HealthEvent{From: from, To: to, Initial: initial})
+	}
+}
+
+// transition applies the damping rules and returns true if the state has changed. Consecutive evaluations worse
+// (or better) than the current state are counted together and the state changes to the one closest to the current
+// state seen during the run, so every counted evaluation supports the transition. Must be called with the lock held
+func (t *HealthTracker) transition(observed HealthState) bool {
+	if observed == t.state {
+		t.count = 0
+		return false
+	}
+	worse := observed < t.state
+	if t.count == 0 || (t.pending < t.state) != worse {
+		t.pending = observed
+		t.count = 0
+	} else if worse {
+		t.pending = max(t.pending, observed)
+	} else {
+		t.pending = min(t.pending, observed)
+	}
+	t.count++
+
+	threshold := t.cfg.Rise
+	if worse {
+		threshold = t.cfg.Fall
+	}
+	now := time.Now()
+	if t.count < threshold || now.Sub(t.since) < t.cfg.MinHold {
+		return false
+	}
+	t.state = t.pending
+	t.since = now
+	t.count = 0
+	return true
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHealthTrackerTransition(t *testing.T) {
+	const (
+		U = HealthUnhealthy
+		D = HealthDegraded
+		H = HealthHealthy
+	)
+	tests := []struct {
+		name    string
+		initial HealthState
+		rise    int
+		fall    int
+		minHold time.Duration
+		// since is the time elapsed since the last transition
+		since    time.Duration
+		observed []HealthState
+		// states are the damped states after each evaluation
+		states []HealthState
+	}{
+		{
+			name:     "rise",
+			initial:  U,
+			rise:     3,
+			fall:     1,
+			observed: []HealthState{H, H, H, H},
+			states:   []HealthState{U, U, H, H},
+		},
+		{
+			name:     "interrupted rise",
+			initial:  U,
+			rise:     3,
+			fall:     1,
+			observed: []HealthState{H, H, U, H, H, H},
+			states:   []HealthState{U, U, U, U, U, H},
+		},
+		{
+			name:     "mixed rise moves to the worst state of the run",
+			initial:  U,
+			rise:     3,
+			fall:     1,
+			observed: []HealthState{D, H, D},
+			states:   []HealthState{U, U, D},
+		},
+		{
+			name:     "mixed rise with a single healthy evaluation",
+			initial:  U,
+			rise:     3,
+			fall:     1,
+			observed: []HealthState{H, D, D, H, H, H},
+			states:   []HealthState{U, U, D, D, D, H},
+		},
+		{
+			name:     "fall",
+			initial:  H,
+			rise:     1,
+			fall:     2,
+			observed: []HealthState{U, U},
+			states:   []HealthState{H, U},
+		},
+		{
+			name:     "mixed fall moves to the best state of the run",
+			initial:  H,
+			rise:     1,
+			fall:     3,
+			observed: []HealthState{D, U, D},
+			states:   []HealthState{H, H, D},
+		},
+		{
+			name:     "mixed fall with a single unhealthy evaluation",
+			initial:  H,
+			rise:     5,
+			fall:     2,
+			observed: []HealthState{U, D, U, U},
+			states:   []HealthState{H, D, D, U},
+		},
+		{
+			name:     "direction change restarts the run",
+			initial:  D,
+			rise:     2,
+			fall:     2,
+			observed: []HealthState{H, U, H, H},
+			states:   []HealthState{D, D, D, H},
+		},
+		{
+			name:     "current state resets the run",
+			initial:  D,
+			rise:     2,
+			fall:     2,
+			observed: []HealthState{U, D, U, U},
+			states:   []HealthState{D, D, D, U},
+		},
+		{
+			name:     "min hold delays the transition",
+			initial:  U,
+			rise:     1,
+			fall:     1,
+			minHold:  time.Hour,
+			observed: []HealthState{H, H},
+			states:   []HealthState{U, U},
+		},
+		{
+			name:     "min hold elapsed",
+			initial:  U,
+			rise:     2,
+			fall:     1,
+			minHold:  time.Hour,
+			since:    2 * time.Hour,
+			observed: []HealthState{H, H, U},
+			states:   []HealthState{U, H, H},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := (&HealthTrackerConfig{Rise: tt.rise, Fall: tt.fall, MinHold: tt.minHold}).New()
+			tr.state, tr.pending = tt.initial, tt.initial
+			tr.since = time.Now().Add(-tt.since)
+			var states []HealthState
+			for _, o := range tt.observed {
+				prev := tr.state
+				if changed := tr.transition(o); changed != (tr.state != prev) {
+					t.Errorf("transition returned %t for %v -> %v", changed, prev, tr.state)
+				}
+				states = append(states, tr.state)
+			}
+			if !slices.Equal(states, tt.states) {
+				t.Errorf("states %v, want %v", states, tt.states)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWebhookTimeout     = 10 * time.Second
+	defaultWebhookRetries     = 3
+	defaultWebhookRetryDelay  = 5 * time.Second
+	defaultWebhookContentType = "application/json"
+)
+
+// WebhookConfig describes a single webhook sink
+type WebhookConfig struct {
+	Name        string            `yaml:"name"`
+	URL         string            `yaml:"url"`
+	Method      string            `yaml:"method"`
+	Headers     map[string]string `yaml:"headers"`
+	ContentType string            `yaml:"content_type"`
+	// Template is a text/template of the request body. The event is passed as the template data
+	Template string `yaml:"template"`
+	// Events is the list of event types to deliver. All events except heads and checks are delivered by default
+	Events  []string      `yaml:"events"`
+	Nodes   []string      `yaml:"nodes"`
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries is the number of delivery retries. A negative value disables retries
+	Retries    int           `yaml:"retries"`
+	RetryDelay time.Duration `yaml:"retry_delay"`
+}
+
+// Webhook delivers events from the event bus to an HTTP endpoint
+type Webhook struct {
+	cfg    WebhookConfig
+	tmpl   *template.Template
+	client *http.Client
+	bus    *EventBus
+	cancel context.CancelFunc
+	done   chan struct{}
+	metric *prometheus.CounterVec
+}
+
+// MarshalJSON hides the credentials which are often a part of the URL or the headers. Only the URL's host is kept
+func (c WebhookConfig) MarshalJSON() ([]byte, error) {
+	type webhookConfig WebhookConfig
+	out := webhookConfig(c)
+	if u, err := url.Parse(c.URL); err == nil && u.Host != "" {
+		out.URL = u.Scheme + "://" + u.Host + "/" + redacted
+	} else if c.URL != "" {
+		out.URL = redacted
+	}
+	if c.Headers != nil {
+		out.Headers = make(map[string]string, len(c.Headers))
+		for k := range c.Headers {
+			out.Headers[k] = redacted
+		}
+	}
+	return json.Marshal(&out)
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		buf, err := json.Marshal(v)
+		return string(buf), err
+	},
+}
+
+// New returns a webhook sink consuming events from the bus
+func (c *WebhookConfig) New(bus *EventBus, metric *prometheus.CounterVec) (*Webhook, error) {
+	w := &Webhook{
+		cfg:    *c,
+		bus:    bus,
+		metric: metric,
+	}
+	if w.cfg.Method == "" {
+		w.cfg.Method = http.MethodPost
+	}
+	if w.cfg.ContentType == "" {
+		w.cfg.ContentType = defaultWebhookContentType
+	}
+	if w.cfg.Timeout == 0 {
+		w.cfg.Timeout = defaultWebhookTimeout
+	}
+	if w.cfg.Retries == 0 {
+		w.cfg.Retries = defaultWebhookRetries
+	}
+	if w.cfg.RetryDelay == 0 {
+		w.cfg.RetryDelay = defaultWebhookRetryDelay
+	}
+	if w.cfg.Template != "" {
+		var err error
+		if w.tmpl, err = template.New(c.Name).Funcs(webhookFuncs).Parse(c.Template); err != nil {
+			return nil, fmt.Errorf("webhook %s: %w", c.Name, err)
+		}
+	}
+	w.client = &http.Client{Timeout: w.cfg.Timeout}
+	return w, nil
+}
+
+func newWebhookMetric(reg prometheus.Registerer) *prometheus.CounterVec {
+	m := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tezos",
+		Subsystem: "sidecar",
+		Name:      "webhook_deliveries_total",
+		Help:      "The total number of webhook deliveries.",
+	}, []string{"sink", "result"})
+	if reg != nil {
+		reg.MustRegister(m)
+	}
+	return m
+}
+
+func (w *Webhook) log() log.FieldLogger {
+	return log.WithField("webhook", w.cfg.Name)
+}
+
+// Start subscribes to the bus immediately so the events published by the nodes started next aren't missed
+func (w *Webhook) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	w.done = make(chan struct{})
+	sub := w.bus.NewSubscription(w.log())
+	go w.loop(ctx, sub)
+}
+
+func (w *Webhook) Stop(ctx context.Context) error {
+	w.cancel()
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Webhook) match(ev *Event) bool {
+	if len(w.cfg.Nodes) != 0 && !slices.Contains(w.cfg.Nodes, ev.Node) {
+		return false
+	}
+	if len(w.cfg.Events) == 0 {
+		return ev.Type != EventHead && ev.Type != EventCheck
+	}
+	return slices.Contains(w.cfg.Events, ev.Type)
+}
+
+func (w *Webhook) loop(ctx context.Context, sub *Subscription) {
+	defer close(w.done)
+	for {
+		select {
+		case ev, ok := <-sub.C():
+			for _, ev := range sub.Receive(ev, ok) {
+				if !w.process(ctx, ev) {
+					sub.Close()
+					return
+				}
+			}
+		case <-ctx.Done():
+			sub.Close()
+			return
+		}
+	}
+}
+
+// process delivers the event if it matches the filter. It returns false if the context is cancelled
+func (w *Webhook) process(ctx context.Context, ev *Event) bool {
+	if !w.match(ev) {
+		return true
+	}
+	err := w.deliver(ctx, ev)
+	switch {
+	case err == nil:
+		w.metric.With(prometheus.Labels{"sink": w.cfg.Name, "result": "success"}).Inc()
+	case ctx.Err() != nil:
+		return false
+	default:
+		w.metric.With(prometheus.Labels{"sink": w.cfg.Name, "result": "failure"}).Inc()
+		w.log().WithField("event", ev.ID).Error(err)
+	}
+	return true
+}
+
+func (w *Webhook) body(ev *Event) ([]byte, error) {
+	if w.tmpl == nil {
+		return json.Marshal(ev)
+	}
+	var buf bytes.Buffer
+	if err := w.tmpl.Execute(&buf, ev); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type retryableError struct {
+	error
+}
+
+func (w *Webhook) deliver(ctx context.Context, ev *Event) error {
+	body, err := w.body(ev)
+	if err != nil {
+		return err
+	}
+	delay := w.cfg.RetryDelay
+	for i := 0; ; i++ {
+		err = w.send(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*retryableError); !ok || i >= w.cfg.Retries || ctx.Err() != nil {
+			return err
+		}
+		w.log().WithField("event", ev.ID).Warnf("%v, retrying in %v", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func (w *Webhook) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, w.cfg.Method, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.cfg.ContentType)
+	for k, v := range w.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return &retryableError{err}
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("http status %d", res.StatusCode)
+	if res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests {
+		return &retryableError{err}
+	}
+	return err
+}